@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const adminAPIPrefix = "/admin/api/"
+
+type AdminRoom struct {
+	ID          uuid.UUID    `json:"id"`
+	Name        string       `json:"name"`
+	DisplayName string       `json:"displayName"`
+	Topic       string       `json:"topic"`
+	Description string       `json:"description"`
+	AvatarColor string       `json:"avatarColor"`
+	Private     bool         `json:"private"`
+	Ephemeral   bool         `json:"ephemeral"`
+	OwnerID     *uuid.UUID   `json:"ownerId,omitempty"`
+	Members     []uuid.UUID  `json:"members"`
+	Filters     FilterPolicy `json:"filters"`
+}
+
+type AdminClient struct {
+	ID       uuid.UUID   `json:"id"`
+	Name     string      `json:"name"`
+	Presence string      `json:"presence"`
+	Rooms    []uuid.UUID `json:"rooms"`
+}
+
+type adminRoomRequest struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+}
+
+type adminRoomUpdateRequest struct {
+	Name    string        `json:"name"`
+	Filters *FilterPolicy `json:"filters"`
+	RoomUpdate
+}
+
+type adminResolveReportRequest struct {
+	Action    string `json:"action"`
+	Moderator string `json:"moderator"`
+	Note      string `json:"note"`
+}
+
+type adminAnnouncementRequest struct {
+	Message          string `json:"message"`
+	Severity         string `json:"severity"`
+	ExpiresInSeconds int64  `json:"expiresInSeconds"`
+}
+
+// AdminAPI serves the operator endpoints under /admin/api/. Every request
+// needs an "Authorization: Bearer <token>" header with the configured token.
+type AdminAPI struct {
+	server *WsServer
+	token  string
+}
+
+func NewAdminAPI(server *WsServer, token string) *AdminAPI {
+	return &AdminAPI{server: server, token: token}
+}
+
+func (api *AdminAPI) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || api.token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) == 1
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminAPIPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "rooms" && r.Method == http.MethodGet:
+		api.listRooms(w)
+	case path == "rooms" && r.Method == http.MethodPost:
+		api.createRoom(w, r)
+	case len(parts) == 2 && parts[0] == "rooms" && r.Method == http.MethodPatch:
+		api.updateRoom(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "rooms" && r.Method == http.MethodDelete:
+		api.deleteRoom(w, parts[1])
+	case path == "clients" && r.Method == http.MethodGet:
+		api.listClients(w)
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "disconnect" && r.Method == http.MethodPost:
+		api.disconnectClient(w, parts[1])
+	case path == "announcements" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, api.server.announcements.active(time.Now()))
+	case path == "announcements" && r.Method == http.MethodPost:
+		api.announce(w, r)
+	case len(parts) == 2 && parts[0] == "announcements" && r.Method == http.MethodDelete:
+		api.withdrawAnnouncement(w, parts[1])
+	case path == "reports" && r.Method == http.MethodGet:
+		api.listReports(w, r)
+	case len(parts) == 3 && parts[0] == "reports" && parts[2] == "resolve" && r.Method == http.MethodPost:
+		api.resolveReport(w, r, parts[1])
+	case path == "audit" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, api.server.reports.auditTrail())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func newAdminRoom(room *Room) AdminRoom {
+	summary := room.summary()
+	adminRoom := AdminRoom{
+		ID:          summary.ID,
+		Name:        summary.Name,
+		DisplayName: summary.DisplayName,
+		Topic:       summary.Topic,
+		Description: summary.Description,
+		AvatarColor: summary.AvatarColor,
+		Private:     summary.Private,
+		Ephemeral:   summary.Ephemeral,
+		OwnerID:     summary.OwnerID,
+		Members:     make([]uuid.UUID, 0),
+		Filters:     room.filterPolicy(),
+	}
+
+	for _, member := range room.members() {
+		adminRoom.Members = append(adminRoom.Members, member.ID)
+	}
+
+	return adminRoom
+}
+
+func (api *AdminAPI) listRooms(w http.ResponseWriter) {
+	rooms := api.server.roomsSnapshot()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].GetName() < rooms[j].GetName()
+	})
+
+	adminRooms := make([]AdminRoom, 0, len(rooms))
+	for _, room := range rooms {
+		adminRooms = append(adminRooms, newAdminRoom(room))
+	}
+
+	writeJSON(w, http.StatusOK, adminRooms)
+}
+
+func (api *AdminAPI) createRoom(w http.ResponseWriter, r *http.Request) {
+	var request adminRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+		http.Error(w, "a room name is required", http.StatusBadRequest)
+		return
+	}
+	if isDirectMessageName(request.Name) {
+		http.Error(w, "room names starting with "+dmRoomPrefix+" are reserved", http.StatusBadRequest)
+		return
+	}
+
+	if api.server.findRoomByName(request.Name) != nil {
+		http.Error(w, "a room with that name already exists", http.StatusConflict)
+		return
+	}
+
+	room := api.server.createRoom(request.Name, request.Private, nil)
+	api.server.sendRoomLists()
+
+	writeJSON(w, http.StatusCreated, newAdminRoom(room))
+}
+
+func (api *AdminAPI) updateRoom(w http.ResponseWriter, r *http.Request, id string) {
+	room := api.server.findRoomByID(id)
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	var request adminRoomUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" && request.isEmpty() && request.Filters == nil {
+		http.Error(w, "a room name, details or filters to update are required", http.StatusBadRequest)
+		return
+	}
+	if request.Name != "" {
+		name, err := normalizeRoomName(request.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request.Name = name
+	}
+	if !request.isEmpty() {
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if request.Filters != nil {
+		if err := request.Filters.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if request.Name != "" && !canRename(room, request.Name) {
+		http.Error(w, "direct message rooms and names starting with "+dmRoomPrefix+" cannot be renamed to", http.StatusBadRequest)
+		return
+	}
+	if request.Name != "" && !api.server.renameRoom(room, request.Name) {
+		http.Error(w, "a room with that name already exists", http.StatusConflict)
+		return
+	}
+	if request.Filters != nil {
+		room.setFilterPolicy(*request.Filters)
+	}
+	if request.Name != "" || !request.isEmpty() {
+		room.applyUpdate(&request.RoomUpdate)
+		api.server.notifyRoomUpdated(room, nil)
+	}
+
+	writeJSON(w, http.StatusOK, newAdminRoom(room))
+}
+
+func (api *AdminAPI) deleteRoom(w http.ResponseWriter, id string) {
+	room := api.server.findRoomByID(id)
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	api.server.deleteRoom(room)
+	api.server.sendRoomLists()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *AdminAPI) listClients(w http.ResponseWriter) {
+	clients := api.server.clientsSnapshot()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Name < clients[j].Name
+	})
+
+	adminClients := make([]AdminClient, 0, len(clients))
+	for _, client := range clients {
+		adminClient := AdminClient{
+			ID:       client.ID,
+			Name:     client.Name,
+			Presence: client.visiblePresence(),
+			Rooms:    make([]uuid.UUID, 0),
+		}
+		for _, room := range api.server.roomsSnapshot() {
+			if room.hasClientID(client.ID) {
+				adminClient.Rooms = append(adminClient.Rooms, room.ID)
+			}
+		}
+		adminClients = append(adminClients, adminClient)
+	}
+
+	writeJSON(w, http.StatusOK, adminClients)
+}
+
+func (api *AdminAPI) disconnectClient(w http.ResponseWriter, id string) {
+	client := api.server.findClientByID(id)
+	if client == nil {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	client.logger().Info("Disconnecting client on admin request")
+	client.close()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *AdminAPI) announce(w http.ResponseWriter, r *http.Request) {
+	var request adminAnnouncementRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Message == "" {
+		http.Error(w, "a message is required", http.StatusBadRequest)
+		return
+	}
+	if request.ExpiresInSeconds < 0 {
+		http.Error(w, "expiresInSeconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	if request.ExpiresInSeconds > int64(maxAnnouncementTTL/time.Second) {
+		http.Error(w, "expiresInSeconds is too large", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(request.ExpiresInSeconds) * time.Second
+	announcement, err := api.server.announce(request.Message, request.Severity, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, announcement)
+}
+
+func (api *AdminAPI) withdrawAnnouncement(w http.ResponseWriter, id string) {
+	announcementID, err := uuid.Parse(id)
+	if err != nil || !api.server.withdrawAnnouncement(announcementID) {
+		http.Error(w, "announcement not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *AdminAPI) listReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != ReportStatusOpen && status != ReportStatusResolved {
+		http.Error(w, "status must be open or resolved", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.server.reports.list(status))
+}
+
+func (api *AdminAPI) resolveReport(w http.ResponseWriter, r *http.Request, id string) {
+	reportID, err := uuid.Parse(id)
+	if err != nil {
+		http.Error(w, errReportNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var request adminResolveReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Moderator == "" {
+		request.Moderator = "admin"
+	}
+
+	report, err := api.server.resolveReport(reportID, request.Action, request.Moderator, request.Note)
+	switch {
+	case errors.Is(err, errInvalidReportAction):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errReportNotFound), errors.Is(err, errRoomNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errReportResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	slog.Info("Resolved report", "reportId", report.ID, "action", request.Action, "moderator", request.Moderator)
+	writeJSON(w, http.StatusOK, report)
+}
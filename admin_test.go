@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "secret"
+
+func adminRequest(t *testing.T, api *AdminAPI, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAPI_RequiresToken(t *testing.T) {
+	api := NewAdminAPI(NewWebsocketServer(), testAdminToken)
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/api/rooms", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/api/rooms", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, api, http.MethodGet, "/admin/api/rooms", "").Code)
+}
+
+func TestAdminAPI_Rooms(t *testing.T) {
+	server := NewWebsocketServer()
+	api := NewAdminAPI(server, testAdminToken)
+	client := newClient(nil, server, "test")
+	server.addClient(client)
+
+	rr := adminRequest(t, api, http.MethodPost, "/admin/api/rooms", `{"name":"general"}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created AdminRoom
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, "general", created.Name)
+	require.NotEmpty(t, client.send, "Expected the client to get the new room list")
+	<-client.send
+
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/rooms", `{"name":"general"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/rooms", `{"name":"dm:general"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"name":"lobby"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotNil(t, server.findRoomByName("lobby"))
+	var updated MessageView
+	require.NoError(t, json.Unmarshal(<-client.send, &updated))
+	assert.Equal(t, RoomUpdatedAction, updated.Action)
+	assert.Equal(t, "lobby", updated.Target.Name)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"topic":"Announcements only"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var patched AdminRoom
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &patched))
+	assert.Equal(t, "lobby", patched.Name)
+	assert.Equal(t, "Announcements only", patched.Topic)
+	<-client.send
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"name":"dm:lobby"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"name":"   "}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"name":"`+strings.Repeat("a", maxRoomNameLength+1)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NotNil(t, server.findRoomByName("lobby"))
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"filters":{"wordAction":"shout"}}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPatch, "/admin/api/rooms/"+created.ID.String(), `{"filters":{"deniedLinks":["spam.example"]}}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &patched))
+	assert.Equal(t, []string{"spam.example"}, patched.Filters.DeniedLinks)
+	assert.Empty(t, client.send, "Expected filters not to be announced to clients")
+
+	rr = adminRequest(t, api, http.MethodGet, "/admin/api/rooms", "")
+	var rooms []AdminRoom
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rooms))
+	require.Len(t, rooms, 1)
+	assert.Equal(t, "lobby", rooms[0].Name)
+
+	rr = adminRequest(t, api, http.MethodDelete, "/admin/api/rooms/"+created.ID.String(), "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Nil(t, server.findRoomByID(created.ID.String()))
+
+	rr = adminRequest(t, api, http.MethodDelete, "/admin/api/rooms/"+created.ID.String(), "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAdminAPI_Clients(t *testing.T) {
+	server := NewWebsocketServer()
+	api := NewAdminAPI(server, testAdminToken)
+	client := newClient(nil, server, "test")
+	server.addClient(client)
+	room := NewRoom("general", false, nil)
+	room.registerClientInRoom(client)
+	server.addRoom(room)
+
+	rr := adminRequest(t, api, http.MethodGet, "/admin/api/clients", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var clients []AdminClient
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &clients))
+	require.Len(t, clients, 1)
+	assert.Equal(t, client.ID, clients[0].ID)
+	assert.Equal(t, PresenceOnline, clients[0].Presence)
+	assert.Equal(t, room.ID, clients[0].Rooms[0])
+
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/clients/"+client.ID.String()+"/disconnect", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/clients/unknown/disconnect", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAdminAPI_Announcements(t *testing.T) {
+	server := NewWebsocketServer()
+	api := NewAdminAPI(server, testAdminToken)
+
+	rr := adminRequest(t, api, http.MethodPost, "/admin/api/announcements", `{"message":"Hi","severity":"loud"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/announcements", `{"message":"Hi","expiresInSeconds":9223372036854775807}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Expected an expiry that overflows to be rejected")
+	rr = adminRequest(t, api, http.MethodPost, "/admin/api/announcements", `{"message":"Hi","expiresInSeconds":`+strconv.FormatInt(int64(maxAnnouncementTTL/time.Second)+1, 10)+`}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- adminRequest(t, api, http.MethodPost, "/admin/api/announcements", `{"message":"Restarting soon","severity":"warning","expiresInSeconds":60}`)
+	}()
+
+	select {
+	case data := <-server.broadcast:
+		var message AnnouncementMessage
+		require.NoError(t, json.Unmarshal(data, &message))
+		assert.Equal(t, SystemAnnouncementAction, message.Action)
+		assert.Equal(t, "Restarting soon", message.Announcement.Message)
+		assert.Equal(t, SeverityWarning, message.Announcement.Severity)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the announcement to be broadcast")
+	}
+
+	rr = <-done
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var announcement Announcement
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &announcement))
+	require.NotNil(t, announcement.ExpiresAt)
+
+	rr = adminRequest(t, api, http.MethodGet, "/admin/api/announcements", "")
+	var active []Announcement
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &active))
+	require.Len(t, active, 1)
+	assert.Equal(t, announcement.ID, active[0].ID)
+
+	go func() {
+		done <- adminRequest(t, api, http.MethodDelete, "/admin/api/announcements/"+announcement.ID.String(), "")
+	}()
+	<-server.broadcast
+	assert.Equal(t, http.StatusNoContent, (<-done).Code)
+
+	rr = adminRequest(t, api, http.MethodDelete, "/admin/api/announcements/"+announcement.ID.String(), "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAdminAPI_Reports(t *testing.T) {
+	server, room, reporter, _ := reportingRoom(t, 1)
+	api := NewAdminAPI(server, testAdminToken)
+	report, err := server.reportMessage(room, reporter, ReportRequest{MessageID: room.history()[0].ID, Reason: "spam"})
+	require.NoError(t, err)
+
+	rr := adminRequest(t, api, http.MethodGet, "/admin/api/reports?status=open", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var reports []Report
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reports))
+	require.Len(t, reports, 1)
+	assert.Equal(t, report.ID, reports[0].ID)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodGet, "/admin/api/reports?status=pending", "").Code)
+
+	path := "/admin/api/reports/" + report.ID.String() + "/resolve"
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodPost, path, `{"action":"shout"}`).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, api, http.MethodPost, "/admin/api/reports/nope/resolve", `{"action":"dismiss"}`).Code)
+
+	rr = adminRequest(t, api, http.MethodPost, path, `{"action":"dismiss","moderator":"alice","note":"not spam"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resolved Report
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resolved))
+	assert.Equal(t, ReportStatusResolved, resolved.Status)
+	assert.Equal(t, "alice", resolved.Resolution.Moderator)
+
+	assert.Equal(t, http.StatusConflict, adminRequest(t, api, http.MethodPost, path, `{"action":"ban"}`).Code)
+
+	rr = adminRequest(t, api, http.MethodGet, "/admin/api/reports?status=open", "")
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reports))
+	assert.Empty(t, reports)
+
+	rr = adminRequest(t, api, http.MethodGet, "/admin/api/audit", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var audit []AuditEntry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &audit))
+	require.Len(t, audit, 1)
+	assert.Equal(t, ReportActionDismiss, audit[0].Action)
+	assert.Equal(t, "not spam", audit[0].Note)
+}
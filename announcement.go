@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+
+	// maxAnnouncementTTL is the longest an announcement can stay active
+	// before it expires, the same bound room retention policies have.
+	maxAnnouncementTTL = maxRetentionAge
+)
+
+var errInvalidSeverity = errors.New("severity must be info, warning or critical")
+
+type Announcement struct {
+	ID        uuid.UUID  `json:"id"`
+	Message   string     `json:"message"`
+	Severity  string     `json:"severity"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (announcement *Announcement) expired(now time.Time) bool {
+	return announcement.ExpiresAt != nil && !now.Before(*announcement.ExpiresAt)
+}
+
+func isSeverity(severity string) bool {
+	switch severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+		return true
+	}
+	return false
+}
+
+// AnnouncementStore keeps the announcements that are still active, so
+// clients connecting after an announcement was made see it as well.
+type AnnouncementStore struct {
+	mu            sync.Mutex
+	announcements []*Announcement
+}
+
+func NewAnnouncementStore() *AnnouncementStore {
+	return &AnnouncementStore{announcements: make([]*Announcement, 0)}
+}
+
+func (store *AnnouncementStore) add(announcement *Announcement) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.announcements = append(store.announcements, announcement)
+}
+
+// active returns the announcements that have not expired, oldest first, and
+// forgets the expired ones.
+func (store *AnnouncementStore) active(now time.Time) []*Announcement {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	active := store.announcements[:0]
+	for _, announcement := range store.announcements {
+		if !announcement.expired(now) {
+			active = append(active, announcement)
+		}
+	}
+	store.announcements = active
+
+	return append([]*Announcement(nil), active...)
+}
+
+func (store *AnnouncementStore) remove(id uuid.UUID) *Announcement {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, announcement := range store.announcements {
+		if announcement.ID == id {
+			store.announcements = append(store.announcements[:i], store.announcements[i+1:]...)
+			return announcement
+		}
+	}
+	return nil
+}
+
+// announce stores an announcement and sends it to every connected client. A
+// zero ttl keeps it until it is withdrawn.
+func (server *WsServer) announce(message, severity string, ttl time.Duration) (*Announcement, error) {
+	if severity == "" {
+		severity = SeverityInfo
+	}
+	if !isSeverity(severity) {
+		return nil, errInvalidSeverity
+	}
+
+	announcement := &Announcement{
+		ID:        uuid.New(),
+		Message:   message,
+		Severity:  severity,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expiresAt := announcement.CreatedAt.Add(ttl)
+		announcement.ExpiresAt = &expiresAt
+	}
+
+	server.announcements.add(announcement)
+
+	announcementMsg := &AnnouncementMessage{
+		Action:       SystemAnnouncementAction,
+		Announcement: announcement,
+	}
+	server.broadcast <- announcementMsg.encode()
+
+	return announcement, nil
+}
+
+// withdrawAnnouncement removes an active announcement and tells clients to
+// stop showing it.
+func (server *WsServer) withdrawAnnouncement(id uuid.UUID) bool {
+	announcement := server.announcements.remove(id)
+	if announcement == nil {
+		return false
+	}
+
+	withdrawnMsg := &AnnouncementMessage{
+		Action:       SystemAnnouncementWithdrawnAction,
+		Announcement: announcement,
+	}
+	server.broadcast <- withdrawnMsg.encode()
+
+	return true
+}
+
+// sendAnnouncements sends a newly connected client the active announcements.
+func (client *Client) sendAnnouncements() {
+	for _, announcement := range client.wsServer.announcements.active(time.Now()) {
+		announcementMsg := &AnnouncementMessage{
+			Action:       SystemAnnouncementAction,
+			Announcement: announcement,
+		}
+		client.enqueue(announcementMsg.encode())
+	}
+}
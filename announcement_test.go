@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncementStore_Active(t *testing.T) {
+	store := NewAnnouncementStore()
+	now := time.Now()
+	expiresAt := now.Add(time.Minute)
+
+	permanent := &Announcement{Message: "permanent"}
+	expiring := &Announcement{Message: "expiring", ExpiresAt: &expiresAt}
+	store.add(permanent)
+	store.add(expiring)
+
+	assert.Equal(t, []*Announcement{permanent, expiring}, store.active(now))
+	assert.Equal(t, []*Announcement{permanent}, store.active(expiresAt))
+	assert.Len(t, store.announcements, 1)
+}
+
+func TestAnnounce(t *testing.T) {
+	server := NewWebsocketServer()
+
+	_, err := server.announce("Hi", "loud", 0)
+	assert.ErrorIs(t, err, errInvalidSeverity)
+
+	go server.announce("Hi", "", time.Minute)
+
+	var message AnnouncementMessage
+	select {
+	case data := <-server.broadcast:
+		require.NoError(t, json.Unmarshal(data, &message))
+	case <-time.After(time.Second):
+		t.Fatal("Expected the announcement to be broadcast")
+	}
+
+	assert.Equal(t, SystemAnnouncementAction, message.Action)
+	assert.Equal(t, SeverityInfo, message.Announcement.Severity)
+	require.NotNil(t, message.Announcement.ExpiresAt)
+	assert.Len(t, server.announcements.active(time.Now()), 1)
+}
+
+func TestSendAnnouncements(t *testing.T) {
+	server := NewWebsocketServer()
+	expired := time.Now().Add(-time.Minute)
+	server.announcements.add(&Announcement{Message: "old", Severity: SeverityInfo, ExpiresAt: &expired})
+	server.announcements.add(&Announcement{Message: "current", Severity: SeverityCritical})
+	client := newClient(nil, server, "test")
+
+	client.sendAnnouncements()
+
+	require.Len(t, client.send, 1)
+	var message AnnouncementMessage
+	require.NoError(t, json.Unmarshal(<-client.send, &message))
+	assert.Equal(t, "current", message.Announcement.Message)
+	assert.Equal(t, SeverityCritical, message.Announcement.Severity)
+}
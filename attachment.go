@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	thumbnailMaxDim  = 256
+	maxImagePixels   = 16 * 1000 * 1000
+	maxAttachments   = 10
+	thumbnailQuality = 80
+
+	// maxConcurrentThumbnails bounds the memory and CPU spent decoding
+	// uploads, since each decode holds up to maxImagePixels in memory.
+	maxConcurrentThumbnails = 2
+	// thumbnailSamples is how many source pixels per side are averaged into
+	// each thumbnail pixel, so scaling costs the same for any image size.
+	thumbnailSamples = 4
+)
+
+var (
+	errTooManyAttachments   = errors.New("too many attachments")
+	errAttachmentType       = errors.New("attachment type is not allowed")
+	errAttachmentTooLarge   = errors.New("attachment is too large")
+	errAttachmentsDisabled  = errors.New("attachments are disabled")
+	errImageTooLarge        = errors.New("image dimensions are too large")
+	errUnsupportedImageType = errors.New("unsupported image type")
+)
+
+// Attachment references a blob in the MediaStore. Everything except the
+// blob ID and file name is filled in by the server from the stored blob.
+type Attachment struct {
+	FileName    string `json:"fileName"`
+	MimeType    string `json:"mimeType"`
+	Size        int64  `json:"size"`
+	BlobID      string `json:"blobId"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	ThumbnailID string `json:"thumbnailId,omitempty"`
+}
+
+// AttachmentPolicy limits what can be attached to a message. Entries in
+// AllowedTypes ending in "/" match a whole top level type such as "image/".
+type AttachmentPolicy struct {
+	AllowedTypes []string
+	MaxSize      int64
+	MaxCount     int
+}
+
+func defaultAttachmentPolicy() AttachmentPolicy {
+	return AttachmentPolicy{
+		AllowedTypes: []string{
+			"image/",
+			"audio/",
+			"video/",
+			"text/plain",
+			"application/pdf",
+			"application/zip",
+		},
+		MaxSize:  1024 * 1024 * 10,
+		MaxCount: maxAttachments,
+	}
+}
+
+func (policy AttachmentPolicy) allows(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range policy.AllowedTypes {
+		if strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed) {
+			return true
+		}
+		if mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveAttachments checks every attachment against the media store and the
+// server's policy and returns them with the stored metadata filled in.
+func (server *WsServer) resolveAttachments(attachments []Attachment) ([]Attachment, error) {
+	if server.media == nil {
+		return nil, errAttachmentsDisabled
+	}
+
+	policy := server.attachmentPolicy
+	if len(attachments) > policy.MaxCount {
+		return nil, errTooManyAttachments
+	}
+
+	resolved := make([]Attachment, 0, len(attachments))
+	for _, attachment := range attachments {
+		info, err := server.media.Stat(attachment.BlobID)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", attachment.BlobID, err)
+		}
+
+		if !policy.allows(info.ContentType) {
+			return nil, fmt.Errorf("%w: %s", errAttachmentType, info.ContentType)
+		}
+		if info.Size > policy.MaxSize {
+			return nil, errAttachmentTooLarge
+		}
+
+		fileName := attachment.FileName
+		if fileName == "" {
+			fileName = info.FileName
+		}
+
+		resolved = append(resolved, Attachment{
+			FileName:    fileName,
+			MimeType:    info.ContentType,
+			Size:        info.Size,
+			BlobID:      info.ID,
+			Width:       info.Width,
+			Height:      info.Height,
+			ThumbnailID: info.ThumbnailID,
+		})
+	}
+
+	return resolved, nil
+}
+
+func isThumbnailable(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// addImageMetadata records the dimensions of an uploaded image and stores a
+// thumbnail for it next to the original. Only images that need a thumbnail
+// are decoded, and no more than maxConcurrentThumbnails at a time.
+func (store *MediaStore) addImageMetadata(info *MediaInfo) error {
+	if !isThumbnailable(info.ContentType) || info.Width > 0 {
+		return nil
+	}
+
+	file, _, err := store.Open(info.ID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImagePixels/config.Height {
+		return errImageTooLarge
+	}
+
+	info.Width = config.Width
+	info.Height = config.Height
+
+	if config.Width > thumbnailMaxDim || config.Height > thumbnailMaxDim {
+		thumbnailID, err := store.saveThumbnail(file, info)
+		if err != nil {
+			return err
+		}
+		info.ThumbnailID = thumbnailID
+	}
+
+	return store.Update(info)
+}
+
+func (store *MediaStore) saveThumbnail(file io.ReadSeeker, info *MediaInfo) (string, error) {
+	store.thumbnails <- struct{}{}
+	defer func() { <-store.thumbnails }()
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := encodeThumbnail(scaleImage(img, thumbnailMaxDim), info.ContentType)
+	if err != nil {
+		return "", err
+	}
+
+	thumbnail, err := store.Save(bytes.NewReader(data), "thumbnail-"+info.FileName)
+	if err != nil {
+		return "", err
+	}
+
+	return thumbnail.ID, nil
+}
+
+func encodeThumbnail(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality})
+	case "image/png", "image/gif":
+		err = png.Encode(&buf, img)
+	default:
+		err = errUnsupportedImageType
+	}
+
+	return buf.Bytes(), err
+}
+
+// scaleImage shrinks src so that neither side exceeds maxDim. Each
+// destination pixel averages up to thumbnailSamples by thumbnailSamples
+// evenly spaced source pixels from the area it covers, so the cost depends on
+// the size of the result rather than of src.
+func scaleImage(src image.Image, maxDim int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	dstWidth, dstHeight := width, height
+	if width >= height && width > maxDim {
+		dstWidth = maxDim
+		dstHeight = max(1, height*maxDim/width)
+	} else if height > width && height > maxDim {
+		dstHeight = maxDim
+		dstWidth = max(1, width*maxDim/height)
+	}
+
+	columns := make([][]int, dstWidth)
+	for x := range columns {
+		x0 := bounds.Min.X + x*width/dstWidth
+		columns[x] = samplePoints(x0, max(x0+1, bounds.Min.X+(x+1)*width/dstWidth))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*height/dstHeight
+		rows := samplePoints(y0, max(y0+1, bounds.Min.Y+(y+1)*height/dstHeight))
+
+		for x, column := range columns {
+			var r, g, b, a, n uint64
+			for _, sy := range rows {
+				for _, sx := range column {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+// samplePoints returns up to thumbnailSamples evenly spaced points in
+// [from, to).
+func samplePoints(from, to int) []int {
+	count := min(to-from, thumbnailSamples)
+	points := make([]int, count)
+	for i := range points {
+		points[i] = from + i*(to-from)/count
+	}
+	return points
+}
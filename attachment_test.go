@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestAttachmentPolicy_allows(t *testing.T) {
+	policy := defaultAttachmentPolicy()
+
+	assert.True(t, policy.allows("image/png"))
+	assert.True(t, policy.allows("text/plain; charset=utf-8"))
+	assert.False(t, policy.allows("application/octet-stream"))
+	assert.False(t, policy.allows("text/html; charset=utf-8"))
+}
+
+func TestScaleImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+
+	thumbnail := scaleImage(img, 256)
+
+	assert.Equal(t, 256, thumbnail.Bounds().Dx())
+	assert.Equal(t, 128, thumbnail.Bounds().Dy())
+}
+
+// countingImage counts how often its pixels are read.
+type countingImage struct {
+	image.Image
+	reads int
+}
+
+func (img *countingImage) At(x, y int) color.Color {
+	img.reads++
+	return img.Image.At(x, y)
+}
+
+func TestScaleImage_BoundedReads(t *testing.T) {
+	img := &countingImage{Image: image.NewRGBA(image.Rect(0, 0, 4000, 3000))}
+
+	thumbnail := scaleImage(img, 256)
+
+	assert.Equal(t, 256, thumbnail.Bounds().Dx())
+	assert.LessOrEqual(t, img.reads, 256*192*thumbnailSamples*thumbnailSamples)
+}
+
+func TestMediaStore_addImageMetadataTooLarge(t *testing.T) {
+	store := newTestMediaStore(t, 1024*1024)
+	header := encodeTestPNG(t, 1, 1)
+	// Only the IHDR chunk is read, so the pixel data does not have to match
+	// the dimensions for the image to be rejected.
+	binary.BigEndian.PutUint32(header[16:20], 5000)
+	binary.BigEndian.PutUint32(header[20:24], 4000)
+	binary.BigEndian.PutUint32(header[29:33], crc32.ChecksumIEEE(header[12:29]))
+	info, err := store.Save(bytes.NewReader(header), "huge.png")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, store.addImageMetadata(info), errImageTooLarge)
+	assert.Empty(t, info.ThumbnailID)
+}
+
+func TestMediaStore_addImageMetadata(t *testing.T) {
+	store := newTestMediaStore(t, 1024*1024)
+	info, err := store.Save(bytes.NewReader(encodeTestPNG(t, 400, 300)), "photo.png")
+	require.NoError(t, err)
+
+	require.NoError(t, store.addImageMetadata(info))
+
+	stored, err := store.Stat(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 400, stored.Width)
+	assert.Equal(t, 300, stored.Height)
+	require.NotEmpty(t, stored.ThumbnailID)
+
+	file, _, err := store.Open(stored.ThumbnailID)
+	require.NoError(t, err)
+	defer file.Close()
+	config, err := png.DecodeConfig(file)
+	require.NoError(t, err)
+	assert.Equal(t, 256, config.Width)
+	assert.Equal(t, 192, config.Height)
+}
+
+func TestResolveAttachments(t *testing.T) {
+	server := NewWebsocketServer()
+	server.media = newTestMediaStore(t, 1024*1024)
+
+	picture, err := server.media.Save(bytes.NewReader(encodeTestPNG(t, 10, 10)), "small.png")
+	require.NoError(t, err)
+	require.NoError(t, server.media.addImageMetadata(picture))
+
+	resolved, err := server.resolveAttachments([]Attachment{{BlobID: picture.ID, MimeType: "text/html", Size: 1}})
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, "image/png", resolved[0].MimeType)
+	assert.Equal(t, picture.Size, resolved[0].Size)
+	assert.Equal(t, "small.png", resolved[0].FileName)
+	assert.Equal(t, 10, resolved[0].Width)
+	assert.Empty(t, resolved[0].ThumbnailID)
+}
+
+func TestResolveAttachments_Rejects(t *testing.T) {
+	server := NewWebsocketServer()
+	server.media = newTestMediaStore(t, 1024*1024)
+
+	binary, err := server.media.Save(bytes.NewReader([]byte{0, 1, 2, 3}), "blob.bin")
+	require.NoError(t, err)
+
+	_, err = server.resolveAttachments([]Attachment{{BlobID: binary.ID}})
+	assert.ErrorIs(t, err, errAttachmentType)
+
+	_, err = server.resolveAttachments([]Attachment{{BlobID: strings.Repeat("0", 64)}})
+	assert.ErrorIs(t, err, errMediaNotFound)
+
+	_, err = server.resolveAttachments(make([]Attachment, maxAttachments+1))
+	assert.ErrorIs(t, err, errTooManyAttachments)
+}
+
+func TestSendMessage_AttachmentIDFollowsPolicy(t *testing.T) {
+	server := NewWebsocketServer()
+	server.media = newTestMediaStore(t, 1024*1024)
+	alice := connectedClients(server, "alice")[0]
+	room := server.createRoom("general", false, nil)
+	require.True(t, room.join(alice))
+	requireMembers(t, room, 1)
+
+	binary, err := server.media.Save(bytes.NewReader([]byte{0, 1, 2, 3}), "blob.bin")
+	require.NoError(t, err)
+	picture, err := server.media.Save(bytes.NewReader(encodeTestPNG(t, 10, 10)), "small.png")
+	require.NoError(t, err)
+
+	send := func(fields string) {
+		alice.handleNewMessage([]byte(`{"action":"send-message","message":"hi","target":{"id":"` + room.GetId() + `"},` + fields + `}`))
+	}
+
+	send(`"attachmentId":"` + binary.ID + `"`)
+	assert.Empty(t, room.history(), "Expected attachmentId to be held to the attachment policy")
+
+	full := strings.TrimSuffix(strings.Repeat(`{"blobId":"`+picture.ID+`"},`, maxAttachments), ",")
+	send(`"attachmentId":"` + picture.ID + `","attachments":[` + full + `]`)
+	assert.Empty(t, room.history(), "Expected attachmentId to count towards the attachment limit")
+
+	send(`"attachmentId":"` + picture.ID + `"`)
+	require.Len(t, room.history(), 1)
+	assert.Equal(t, picture.ID, room.history()[0].AttachmentID)
+	assert.Empty(t, room.history()[0].Attachments)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+const maxAudioDuration = 5 * time.Minute
+
+var (
+	errUnknownAudioFormat = errors.New("unknown audio format")
+	errAudioTooLong       = errors.New("audio message is too long")
+	errInvalidDuration    = errors.New("invalid audio duration")
+)
+
+// AudioInfo is what could be learned from an audio clip's container. A zero
+// Duration means the container did not say how long the clip is.
+type AudioInfo struct {
+	MimeType string
+	Duration time.Duration
+}
+
+// detectAudio sniffs the container format of data and works out its duration
+// where the container makes that possible.
+func detectAudio(data []byte) (AudioInfo, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return parseMatroska(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return parseOgg(data)
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return parseWav(data)
+	case bytes.HasPrefix(data, []byte("ID3")), isMp3FrameSync(data):
+		return parseMp3(data)
+	}
+
+	return AudioInfo{}, errUnknownAudioFormat
+}
+
+func validateAudio(data []byte) (AudioInfo, error) {
+	info, err := detectAudio(data)
+	if err != nil {
+		return info, err
+	}
+	if info.Duration > maxAudioDuration {
+		return info, errAudioTooLong
+	}
+
+	return info, nil
+}
+
+func parseWav(data []byte) (AudioInfo, error) {
+	info := AudioInfo{MimeType: "audio/wav"}
+
+	var byteRate uint32
+	for pos := 12; pos+8 <= len(data); {
+		chunkID := string(data[pos : pos+4])
+		chunkSize := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+
+		switch chunkID {
+		case "fmt ":
+			if body+12 > len(data) {
+				return info, errUnknownAudioFormat
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8 : body+12])
+		case "data":
+			if byteRate == 0 {
+				return info, errUnknownAudioFormat
+			}
+			if chunkSize > len(data)-body || chunkSize < 0 {
+				chunkSize = len(data) - body
+			}
+			info.Duration = time.Duration(float64(chunkSize) / float64(byteRate) * float64(time.Second))
+			return info, nil
+		}
+
+		pos = body + chunkSize + chunkSize%2
+	}
+
+	// A WAVE header without a format and a data chunk is not audio.
+	return info, errUnknownAudioFormat
+}
+
+func parseOgg(data []byte) (AudioInfo, error) {
+	info := AudioInfo{MimeType: "audio/ogg"}
+
+	const pageHeaderLen = 27
+	if len(data) < pageHeaderLen {
+		return info, errUnknownAudioFormat
+	}
+
+	segments := int(data[26])
+	payload := pageHeaderLen + segments
+	if payload > len(data) {
+		return info, errUnknownAudioFormat
+	}
+	first := data[payload:]
+
+	var sampleRate, preSkip uint64
+	switch {
+	case bytes.HasPrefix(first, []byte("OpusHead")) && len(first) >= 12:
+		sampleRate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(first[10:12]))
+	case bytes.HasPrefix(first, []byte("\x01vorbis")) && len(first) >= 16:
+		sampleRate = uint64(binary.LittleEndian.Uint32(first[12:16]))
+	default:
+		return info, errUnknownAudioFormat
+	}
+
+	// The first page only holds the codec header, so a clip needs at least
+	// one more page.
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last <= 0 || last+14 > len(data) || sampleRate == 0 {
+		return info, errUnknownAudioFormat
+	}
+
+	granule := binary.LittleEndian.Uint64(data[last+6 : last+14])
+	if granule == math.MaxUint64 || granule < preSkip {
+		return info, nil
+	}
+
+	// The granule position is whatever the client wrote, so the duration is
+	// checked before it can overflow a time.Duration.
+	seconds := float64(granule-preSkip) / float64(sampleRate)
+	if seconds > maxAudioDuration.Seconds() {
+		return info, errAudioTooLong
+	}
+	info.Duration = time.Duration(seconds * float64(time.Second))
+
+	return info, nil
+}
+
+var (
+	mp3BitratesV1 = [3][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	}
+	mp3BitratesV2 = [3][16]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = map[int][3]int{
+		3: {44100, 48000, 32000},
+		2: {22050, 24000, 16000},
+		0: {11025, 12000, 8000},
+	}
+)
+
+func isMp3FrameSync(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0
+}
+
+type mp3Frame struct {
+	length  int
+	samples int
+	rate    int
+}
+
+func parseMp3Frame(header []byte) (mp3Frame, bool) {
+	if len(header) < 4 || !isMp3FrameSync(header) {
+		return mp3Frame{}, false
+	}
+
+	version := int(header[1]>>3) & 3
+	layer := int(header[1]>>1) & 3
+	bitrateIndex := int(header[2] >> 4)
+	rateIndex := int(header[2]>>2) & 3
+	padding := int(header[2]>>1) & 1
+
+	if version == 1 || layer == 0 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	// Layer bits count down: 3 is Layer I, 1 is Layer III.
+	layerIndex := 3 - layer
+	var kbps int
+	if version == 3 {
+		kbps = mp3BitratesV1[layerIndex][bitrateIndex]
+	} else {
+		kbps = mp3BitratesV2[layerIndex][bitrateIndex]
+	}
+	if kbps == 0 {
+		return mp3Frame{}, false
+	}
+
+	rate := mp3SampleRates[version][rateIndex]
+	bitrate := kbps * 1000
+
+	frame := mp3Frame{rate: rate}
+	switch {
+	case layerIndex == 0:
+		frame.samples = 384
+		frame.length = (12*bitrate/rate + padding) * 4
+	case layerIndex == 2 && version != 3:
+		frame.samples = 576
+		frame.length = 72*bitrate/rate + padding
+	default:
+		frame.samples = 1152
+		frame.length = 144*bitrate/rate + padding
+	}
+
+	return frame, true
+}
+
+func parseMp3(data []byte) (AudioInfo, error) {
+	info := AudioInfo{MimeType: "audio/mpeg"}
+
+	pos := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		pos = 10 + size
+		if data[5]&0x10 != 0 {
+			pos += 10
+		}
+	}
+
+	var samples, rate, frames int
+	for pos+4 <= len(data) {
+		frame, ok := parseMp3Frame(data[pos:])
+		if !ok {
+			break
+		}
+		samples += frame.samples
+		rate = frame.rate
+		frames++
+		pos += frame.length
+	}
+
+	if frames == 0 {
+		return info, errUnknownAudioFormat
+	}
+
+	info.Duration = time.Duration(samples) * time.Second / time.Duration(rate)
+
+	return info, nil
+}
+
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDDocType       = 0x4282
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDDuration      = 0x4489
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDSimpleBlock   = 0xA3
+	ebmlIDBlockGroup    = 0xA0
+	ebmlIDBlock         = 0xA1
+)
+
+// readEbmlVint reads an EBML variable length integer. With keepMarker the
+// length marker bit is kept, which is how element IDs are written.
+func readEbmlVint(data []byte, keepMarker bool) (value uint64, length int, unknown bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+
+	length = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0, false
+	}
+
+	value = uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+		allOnes = allOnes && data[i] == 0xFF
+	}
+
+	return value, length, allOnes && !keepMarker
+}
+
+func readEbmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// parseMatroska walks the EBML tree of a WebM/Matroska file. The EBML
+// header, Segment, Info, Cluster and BlockGroup are descended into in place,
+// which also copes with the unknown sized elements browsers write while
+// recording. When the header has no Duration, the timestamp of the last block
+// is used instead.
+func parseMatroska(data []byte) (AudioInfo, error) {
+	info := AudioInfo{MimeType: "audio/webm"}
+
+	timecodeScale := uint64(1000000)
+	var duration float64
+	var clusterTimecode, lastBlock uint64
+
+	for pos := 0; pos < len(data); {
+		id, idLen, _ := readEbmlVint(data[pos:], true)
+		if idLen == 0 {
+			break
+		}
+		size, sizeLen, unknown := readEbmlVint(data[pos+idLen:], false)
+		if sizeLen == 0 {
+			break
+		}
+		body := pos + idLen + sizeLen
+
+		switch id {
+		case ebmlIDHeader, ebmlIDSegment, ebmlIDInfo, ebmlIDCluster, ebmlIDBlockGroup:
+			pos = body
+			continue
+		}
+
+		if unknown || size > uint64(len(data)-body) {
+			break
+		}
+		content := data[body : body+int(size)]
+
+		switch id {
+		case ebmlIDDocType:
+			if string(content) == "matroska" {
+				info.MimeType = "audio/x-matroska"
+			}
+		case ebmlIDTimecodeScale:
+			timecodeScale = readEbmlUint(content)
+		case ebmlIDDuration:
+			switch len(content) {
+			case 4:
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(content)))
+			case 8:
+				duration = math.Float64frombits(binary.BigEndian.Uint64(content))
+			}
+		case ebmlIDTimecode:
+			clusterTimecode = readEbmlUint(content)
+		case ebmlIDSimpleBlock, ebmlIDBlock:
+			_, trackLen, _ := readEbmlVint(content, false)
+			if trackLen > 0 && len(content) >= trackLen+2 {
+				relative := int16(binary.BigEndian.Uint16(content[trackLen : trackLen+2]))
+				if timestamp := int64(clusterTimecode) + int64(relative); timestamp > int64(lastBlock) {
+					lastBlock = uint64(timestamp)
+				}
+			}
+		}
+
+		pos = body + int(size)
+	}
+
+	if duration == 0 {
+		duration = float64(lastBlock)
+	}
+
+	// The Duration element is a float the client chose, so it has to be
+	// checked before it can safely become a time.Duration.
+	nanoseconds := duration * float64(timecodeScale)
+	switch {
+	case math.IsNaN(nanoseconds) || nanoseconds < 0:
+		return info, errInvalidDuration
+	case nanoseconds > float64(maxAudioDuration):
+		return info, errAudioTooLong
+	}
+	info.Duration = time.Duration(nanoseconds)
+
+	return info, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildWav(sampleRate, seconds int) []byte {
+	byteRate := sampleRate * 2
+	dataSize := byteRate * seconds
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(36+dataSize))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, uint16(1))
+	binary.Write(buf, binary.LittleEndian, uint16(1))
+	binary.Write(buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(byteRate))
+	binary.Write(buf, binary.LittleEndian, uint16(2))
+	binary.Write(buf, binary.LittleEndian, uint16(16))
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, uint32(dataSize))
+	buf.Write(make([]byte, dataSize))
+	return buf.Bytes()
+}
+
+func oggPage(granule uint64, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("OggS")
+	buf.Write([]byte{0, 0})
+	binary.Write(buf, binary.LittleEndian, granule)
+	buf.Write(make([]byte, 12))
+	buf.WriteByte(1)
+	buf.WriteByte(byte(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func ebmlElement(id []byte, payload []byte) []byte {
+	element := append([]byte{}, id...)
+	element = append(element, 0x40|byte(len(payload)>>8), byte(len(payload)))
+	return append(element, payload...)
+}
+
+func ebmlHeader(docType string) []byte {
+	return ebmlElement([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebmlElement([]byte{0x42, 0x82}, []byte(docType)))
+}
+
+func TestDetectAudio_Wav(t *testing.T) {
+	info, err := detectAudio(buildWav(8000, 2))
+
+	require.NoError(t, err)
+	assert.Equal(t, "audio/wav", info.MimeType)
+	assert.Equal(t, 2*time.Second, info.Duration)
+}
+
+func opusHead() []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, 1)
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	return append(head, 0, 0, 0)
+}
+
+func TestDetectAudio_OggOpus(t *testing.T) {
+	data := append(oggPage(0, opusHead()), oggPage(48000*3+312, []byte{0})...)
+	info, err := detectAudio(data)
+
+	require.NoError(t, err)
+	assert.Equal(t, "audio/ogg", info.MimeType)
+	assert.Equal(t, 3*time.Second, info.Duration)
+}
+
+func TestDetectAudio_OggHugeGranule(t *testing.T) {
+	data := append(oggPage(0, opusHead()), oggPage(1<<62, []byte{0})...)
+
+	_, err := detectAudio(data)
+
+	assert.ErrorIs(t, err, errAudioTooLong, "Expected a huge granule position not to overflow")
+}
+
+func TestDetectAudio_NoAudioData(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"ogg header only":   oggPage(0, opusHead()),
+		"ogg unknown codec": append(oggPage(0, []byte("garbage")), oggPage(48000, []byte{0})...),
+		"ogg truncated":     []byte("OggS garbage"),
+		"wav header only":   []byte("RIFF\x04\x00\x00\x00WAVE"),
+		"wav without fmt":   []byte("RIFF\x10\x00\x00\x00WAVEdata\x04\x00\x00\x00\x00\x00\x00\x00"),
+	} {
+		_, err := detectAudio(data)
+		assert.ErrorIs(t, err, errUnknownAudioFormat, name)
+	}
+}
+
+func TestDetectAudio_Mp3(t *testing.T) {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	data := []byte("ID3\x03\x00\x00\x00\x00\x00\x00")
+	for i := 0; i < 100; i++ {
+		data = append(data, frame...)
+	}
+
+	info, err := detectAudio(data)
+
+	require.NoError(t, err)
+	assert.Equal(t, "audio/mpeg", info.MimeType)
+	assert.Equal(t, int64(2612), info.Duration.Milliseconds())
+}
+
+// webmWithDuration builds a WebM file whose Info says it lasts duration
+// milliseconds.
+func webmWithDuration(duration float64) []byte {
+	durationBits := binary.BigEndian.AppendUint64(nil, math.Float64bits(duration))
+	segmentInfo := append(
+		ebmlElement([]byte{0x2A, 0xD7, 0xB1}, []byte{0x0F, 0x42, 0x40}),
+		ebmlElement([]byte{0x44, 0x89}, durationBits)...,
+	)
+	data := ebmlHeader("webm")
+	data = append(data, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(data, ebmlElement([]byte{0x15, 0x49, 0xA9, 0x66}, segmentInfo)...)
+}
+
+func TestDetectAudio_WebmDuration(t *testing.T) {
+	info, err := detectAudio(webmWithDuration(1500))
+
+	require.NoError(t, err)
+	assert.Equal(t, "audio/webm", info.MimeType)
+	assert.Equal(t, 1500*time.Millisecond, info.Duration)
+}
+
+func TestDetectAudio_WebmInvalidDuration(t *testing.T) {
+	_, err := detectAudio(webmWithDuration(-5000))
+	assert.ErrorIs(t, err, errInvalidDuration)
+
+	_, err = detectAudio(webmWithDuration(math.NaN()))
+	assert.ErrorIs(t, err, errInvalidDuration)
+
+	_, err = detectAudio(webmWithDuration(1e20))
+	assert.ErrorIs(t, err, errAudioTooLong, "Expected a huge duration not to overflow")
+
+	_, err = detectAudio(webmWithDuration(math.Inf(1)))
+	assert.ErrorIs(t, err, errAudioTooLong)
+}
+
+func TestDetectAudio_WebmWithoutDuration(t *testing.T) {
+	unknownCluster := []byte{0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+	data := ebmlHeader("webm")
+	data = append(data, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	data = append(data, unknownCluster...)
+	data = append(data, ebmlElement([]byte{0xE7}, []byte{0x00})...)
+	data = append(data, ebmlElement([]byte{0xA3}, []byte{0x81, 0x03, 0xE8, 0x80, 0x00})...)
+	data = append(data, unknownCluster...)
+	data = append(data, ebmlElement([]byte{0xE7}, []byte{0x07, 0xD0})...)
+	data = append(data, ebmlElement([]byte{0xA3}, []byte{0x81, 0x01, 0xF4, 0x80, 0x00})...)
+
+	info, err := detectAudio(data)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, info.Duration)
+}
+
+func TestDetectAudio_Unknown(t *testing.T) {
+	_, err := detectAudio([]byte("definitely not audio"))
+
+	assert.ErrorIs(t, err, errUnknownAudioFormat)
+}
+
+func TestValidateAudio_TooLong(t *testing.T) {
+	_, err := validateAudio(buildWav(10, int(maxAudioDuration/time.Second)+1))
+
+	assert.ErrorIs(t, err, errAudioTooLong)
+}
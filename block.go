@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// BlockList remembers who each user has blocked, keyed by user ID so blocks
+// survive reconnects.
+type BlockList struct {
+	mu      sync.Mutex
+	blocked map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func NewBlockList() *BlockList {
+	return &BlockList{
+		blocked: make(map[uuid.UUID]map[uuid.UUID]bool),
+	}
+}
+
+func (blocks *BlockList) block(userID, blockedID uuid.UUID) {
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+
+	if blocks.blocked[userID] == nil {
+		blocks.blocked[userID] = make(map[uuid.UUID]bool)
+	}
+	blocks.blocked[userID][blockedID] = true
+}
+
+func (blocks *BlockList) unblock(userID, blockedID uuid.UUID) {
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+
+	delete(blocks.blocked[userID], blockedID)
+	if len(blocks.blocked[userID]) == 0 {
+		delete(blocks.blocked, userID)
+	}
+}
+
+func (blocks *BlockList) isBlocked(userID, blockedID uuid.UUID) bool {
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+
+	return blocks.blocked[userID][blockedID]
+}
+
+func (blocks *BlockList) list(userID uuid.UUID) []uuid.UUID {
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+
+	blocked := make([]uuid.UUID, 0, len(blocks.blocked[userID]))
+	for id := range blocks.blocked[userID] {
+		blocked = append(blocked, id)
+	}
+
+	return blocked
+}
+
+// hasBlocked reports whether client has blocked the user with the given ID.
+func (client *Client) hasBlocked(id uuid.UUID) bool {
+	if client.wsServer == nil || id == uuid.Nil {
+		return false
+	}
+
+	return client.wsServer.blocks.isBlocked(client.ID, id)
+}
+
+// broadcastSubject returns the user a broadcast comes from or is about, for
+// the broadcasts that are hidden from clients who blocked that user: their
+// messages and typing in shared rooms, and their comings and goings.
+func broadcastSubject(message []byte) uuid.UUID {
+	var broadcast struct {
+		Action string    `json:"action"`
+		UserID uuid.UUID `json:"userId"`
+		Sender *struct {
+			ID uuid.UUID `json:"id"`
+		} `json:"sender"`
+		Client *struct {
+			ID uuid.UUID `json:"id"`
+		} `json:"client"`
+	}
+	if json.Unmarshal(message, &broadcast) != nil {
+		return uuid.Nil
+	}
+
+	switch broadcast.Action {
+	case SendMessageAction, AudioMessageAction, TypingAction:
+		if broadcast.Sender != nil {
+			return broadcast.Sender.ID
+		}
+	case UserJoinedAction, UserLeftAction:
+		if broadcast.Client != nil {
+			return broadcast.Client.ID
+		}
+	case PresenceUpdateAction:
+		return broadcast.UserID
+	}
+
+	return uuid.Nil
+}
+
+// withoutBlocked leaves the messages of users client blocked out of messages.
+func (client *Client) withoutBlocked(messages []Message) []Message {
+	visible := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		if message.Sender == nil || !client.hasBlocked(message.Sender.ID) {
+			visible = append(visible, message)
+		}
+	}
+
+	return visible
+}
+
+func (client *Client) sendBlockedUsers() {
+	blockedMsg := &BlockedUsersMessage{
+		Action:  BlockedUsersAction,
+		UserIDs: client.wsServer.blocks.list(client.ID),
+	}
+	client.enqueue(blockedMsg.encode())
+}
+
+func (client *Client) handleBlockUserMessage(message Message) {
+	id, err := uuid.Parse(message.Message)
+	if err != nil || id == client.ID {
+		client.logger().Warn("Invalid user to block", "action", message.Action, "userId", message.Message)
+		return
+	}
+
+	client.wsServer.blocks.block(client.ID, id)
+	client.logger().Info("Blocked user", "blockedId", id)
+	client.sendBlockedUsers()
+}
+
+func (client *Client) handleUnblockUserMessage(message Message) {
+	id, err := uuid.Parse(message.Message)
+	if err != nil {
+		client.logger().Warn("Invalid user to unblock", "action", message.Action, "userId", message.Message)
+		return
+	}
+
+	client.wsServer.blocks.unblock(client.ID, id)
+	client.sendBlockedUsers()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockList(t *testing.T) {
+	blocks := NewBlockList()
+	user, other := uuid.New(), uuid.New()
+
+	blocks.block(user, other)
+	assert.True(t, blocks.isBlocked(user, other))
+	assert.False(t, blocks.isBlocked(other, user), "Expected blocking to be one way")
+	assert.Equal(t, []uuid.UUID{other}, blocks.list(user))
+
+	blocks.unblock(user, other)
+	assert.False(t, blocks.isBlocked(user, other))
+	assert.Empty(t, blocks.list(user))
+}
+
+func TestBlockUser(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob")
+	alice, bob := clients[0], clients[1]
+
+	alice.handleNewMessage([]byte(`{"action":"block-user","message":"` + bob.ID.String() + `"}`))
+
+	var blocked BlockedUsersMessage
+	require.NoError(t, json.Unmarshal(<-alice.send, &blocked))
+	assert.Equal(t, BlockedUsersAction, blocked.Action)
+	assert.Equal(t, []uuid.UUID{bob.ID}, blocked.UserIDs)
+
+	alice.handleNewMessage([]byte(`{"action":"block-user","message":"` + alice.ID.String() + `"}`))
+	alice.handleNewMessage([]byte(`{"action":"block-user","message":"nobody"}`))
+	assert.Empty(t, alice.send)
+
+	alice.handleNewMessage([]byte(`{"action":"unblock-user","message":"` + bob.ID.String() + `"}`))
+	require.NoError(t, json.Unmarshal(<-alice.send, &blocked))
+	assert.Empty(t, blocked.UserIDs)
+	assert.False(t, alice.hasBlocked(bob.ID))
+}
+
+func TestBlockUser_DirectMessages(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol")
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	server.blocks.block(alice.ID, bob.ID)
+
+	bob.handleNewMessage([]byte(`{"action":"join-room-private","message":"` + alice.ID.String() + `"}`))
+	bob.handleNewMessage([]byte(`{"action":"create-dm","participants":` + participantsJSON(alice, carol) + `}`))
+	assert.Empty(t, server.roomsSnapshot(), "Expected blocked users not to open direct messages")
+
+	carol.handleNewMessage([]byte(`{"action":"join-room-private","message":"` + alice.ID.String() + `"}`))
+	assert.Len(t, server.roomsSnapshot(), 1)
+}
+
+func TestBlockUser_SharedRoom(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol")
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	room := server.createRoom("general", false, nil)
+	for _, client := range clients {
+		require.True(t, room.join(client))
+	}
+	requireMembers(t, room, 3)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+	server.blocks.block(alice.ID, bob.ID)
+
+	bob.handleNewMessage([]byte(`{"action":"send-message","message":"hi @alice","target":{"id":"` + room.GetId() + `"}}`))
+
+	// Members are delivered to in the order they joined, so alice has had
+	// her turn once carol has the message.
+	var received MessageView
+	require.NoError(t, json.Unmarshal(<-carol.send, &received))
+	assert.Equal(t, "hi @alice", received.Message)
+	assert.Empty(t, alice.send, "Expected the blocked user's message and mention to be filtered")
+	assert.Empty(t, server.mentions.list(alice.ID))
+
+	alice.notifyRoomJoined(room, nil)
+	var joined RoomJoinedMessage
+	require.NoError(t, json.Unmarshal(<-alice.send, &joined))
+	assert.Empty(t, joined.Messages, "Expected the blocked user's messages to be left out of the history")
+}
+
+func TestBlockUser_OnlineList(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol")
+	alice, bob := clients[0], clients[1]
+	server.blocks.block(alice.ID, bob.ID)
+
+	online := server.onlineClients(alice)
+	assert.Len(t, online, 2)
+	assert.NotContains(t, online, bob)
+	assert.Contains(t, server.onlineClients(bob), alice)
+
+	server.publishToClients(nil, server.presenceUpdate(bob).encode())
+	assert.Empty(t, alice.send, "Expected the blocked user's presence to be hidden")
+	assert.NotEmpty(t, clients[2].send)
+}
+
+func TestBroadcastSubject(t *testing.T) {
+	client := newClient(nil, nil, "test")
+	room := NewRoom("general", false, nil)
+
+	assert.Equal(t, client.ID, broadcastSubject((&Message{Action: SendMessageAction, Sender: client, Target: room}).encode()))
+	assert.Equal(t, client.ID, broadcastSubject(client.typingMessage(room, true).encode()))
+	assert.Equal(t, client.ID, broadcastSubject((&ClientEventMessage{Action: UserJoinedAction, Client: client.summary()}).encode()))
+	assert.Equal(t, client.ID, broadcastSubject(presenceUpdate(client.ID, PresenceAway)))
+	assert.Equal(t, uuid.Nil, broadcastSubject((&Message{Action: RoomUpdatedAction, Sender: client, Target: room}).encode()))
+	assert.Equal(t, uuid.Nil, broadcastSubject([]byte("not json")))
+}
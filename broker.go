@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// clientsTopic carries messages meant for every connected client, such as
+// presence changes and announcements.
+const clientsTopic = "clients"
+
+// roomNamespace derives room IDs from room names, so every node that creates
+// a room with the same name gives it the same ID and topic.
+var roomNamespace = uuid.MustParse("0b5a3c2e-6f1d-4b8e-9a47-2d6c1e8f3b90")
+
+// Broker fans messages out to every node of the chat server. Each node
+// subscribes to the topics it has local clients for and delivers what it
+// receives to them, including messages it published itself.
+type Broker interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string, handler func(payload []byte)) (unsubscribe func(), err error)
+	// Check reports whether the broker can currently deliver messages.
+	Check() error
+	Close() error
+}
+
+// LocalBroker is the in-process Broker used when the server runs as a single
+// node. Handlers are called synchronously by Publish.
+type LocalBroker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[int]func([]byte)
+	nextID      int
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{subscribers: make(map[string]map[int]func([]byte))}
+}
+
+func (broker *LocalBroker) Publish(topic string, payload []byte) error {
+	broker.mu.RLock()
+	handlers := make([]func([]byte), 0, len(broker.subscribers[topic]))
+	for _, handler := range broker.subscribers[topic] {
+		handlers = append(handlers, handler)
+	}
+	broker.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+
+	return nil
+}
+
+func (broker *LocalBroker) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	id := broker.nextID
+	broker.nextID++
+	if broker.subscribers[topic] == nil {
+		broker.subscribers[topic] = make(map[int]func([]byte))
+	}
+	broker.subscribers[topic][id] = handler
+
+	return func() {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+
+		delete(broker.subscribers[topic], id)
+		if len(broker.subscribers[topic]) == 0 {
+			delete(broker.subscribers, topic)
+		}
+	}, nil
+}
+
+func (broker *LocalBroker) Check() error {
+	return nil
+}
+
+func (broker *LocalBroker) Close() error {
+	return nil
+}
+
+func roomTopic(id uuid.UUID) string {
+	return "room:" + id.String()
+}
+
+// clientsEnvelope wraps messages on the clients topic. Exclude is set when
+// the message should not go back to the client it is about.
+type clientsEnvelope struct {
+	Exclude *uuid.UUID `json:"exclude,omitempty"`
+	Payload []byte     `json:"payload"`
+}
+
+// publishToClients sends message to the connected clients of every node,
+// except the client with the exclude ID.
+func (server *WsServer) publishToClients(exclude *uuid.UUID, message []byte) {
+	envelope, err := json.Marshal(clientsEnvelope{Exclude: exclude, Payload: message})
+	if err != nil {
+		slog.Error("Error encoding broker envelope", "error", err)
+		return
+	}
+
+	if err := server.broker.Publish(clientsTopic, envelope); err != nil {
+		slog.Error("Error publishing to broker", "topic", clientsTopic, "error", err)
+	}
+}
+
+func (server *WsServer) deliverToClients(data []byte) {
+	var envelope clientsEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		slog.Error("Error decoding broker envelope", "error", err)
+		return
+	}
+
+	key := coalesceKey(envelope.Payload)
+	subject := broadcastSubject(envelope.Payload)
+	for _, client := range server.clientsSnapshot() {
+		if (envelope.Exclude == nil || client.ID != *envelope.Exclude) && !client.hasBlocked(subject) {
+			client.enqueueKeyed(envelope.Payload, key)
+		}
+	}
+}
+
+// subscribeRoom starts delivering the room's broker topic to its local
+// members.
+func (server *WsServer) subscribeRoom(room *Room) {
+	unsubscribe, err := server.broker.Subscribe(roomTopic(room.ID), room.broadcastToClientsInRoom)
+	if err != nil {
+		slog.Error("Error subscribing to room", roomAttr(room), "error", err)
+		return
+	}
+
+	room.broker = server.broker
+	room.unsubscribe = unsubscribe
+}
+
+// publish sends an encoded message to the members of the room on every node.
+// Rooms that were never subscribed deliver locally.
+func (room *Room) publish(message []byte) {
+	if room.broker == nil {
+		room.broadcastToClientsInRoom(message)
+		return
+	}
+
+	if err := room.broker.Publish(roomTopic(room.ID), message); err != nil {
+		slog.Error("Error publishing to broker", roomAttr(room), "error", err)
+	}
+}
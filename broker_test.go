@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalBroker_PublishSubscribe(t *testing.T) {
+	broker := NewLocalBroker()
+
+	var received [][]byte
+	unsubscribe, err := broker.Subscribe("topic", func(payload []byte) {
+		received = append(received, payload)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, broker.Publish("topic", []byte("hello")))
+	require.NoError(t, broker.Publish("other", []byte("ignored")))
+	assert.Equal(t, [][]byte{[]byte("hello")}, received)
+
+	unsubscribe()
+	require.NoError(t, broker.Publish("topic", []byte("gone")))
+	assert.Len(t, received, 1)
+	assert.Empty(t, broker.subscribers)
+}
+
+func TestPublishToClients_Exclude(t *testing.T) {
+	server := NewWebsocketServer()
+	sender := newClient(nil, server, "sender")
+	other := newClient(nil, server, "other")
+	server.addClient(sender)
+	server.addClient(other)
+
+	server.publishToClients(&sender.ID, []byte("hello"))
+
+	assert.Empty(t, sender.send)
+	require.Len(t, other.send, 1)
+	assert.Equal(t, []byte("hello"), <-other.send)
+}
+
+func TestCreateRoom_SubscribesToBroker(t *testing.T) {
+	server := NewWebsocketServer()
+	room := server.createRoom("general", false, nil)
+	client := newClient(nil, server, "test")
+	room.registerClientInRoom(client)
+
+	assert.Equal(t, room.ID, NewWebsocketServer().createRoom("general", false, nil).ID, "Expected room IDs to follow from the name")
+
+	room.publish([]byte("hello"))
+	require.Len(t, client.send, 1)
+	assert.Equal(t, []byte("hello"), <-client.send)
+
+	server.deleteRoom(room)
+	var deleted RoomEventMessage
+	require.NoError(t, json.Unmarshal(<-client.send, &deleted))
+	assert.Equal(t, RoomDeletedAction, deleted.Action)
+
+	room.publish([]byte("gone"))
+	assert.Empty(t, client.send)
+}
+
+// slowBroker holds up room subscriptions until release is closed, like a
+// broker that is slow to answer.
+type slowBroker struct {
+	*LocalBroker
+	release chan struct{}
+}
+
+func (broker slowBroker) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	if strings.HasPrefix(topic, "room:") {
+		<-broker.release
+	}
+	return broker.LocalBroker.Subscribe(topic, handler)
+}
+
+func TestCreateRoom_SubscribesWithoutLock(t *testing.T) {
+	broker := slowBroker{LocalBroker: NewLocalBroker(), release: make(chan struct{})}
+	server, err := NewWebsocketServerWithBroker(broker)
+	require.NoError(t, err)
+
+	created := make(chan *Room, 2)
+	for i := 0; i < 2; i++ {
+		go func() { created <- server.createRoom("general", false, nil) }()
+	}
+
+	looked := make(chan struct{})
+	go func() {
+		server.findRoomByName("general")
+		server.clientsSnapshot()
+		close(looked)
+	}()
+	select {
+	case <-looked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected lookups not to wait for the broker")
+	}
+
+	close(broker.release)
+	first, second := <-created, <-created
+	assert.Same(t, first, second, "Expected both callers to get the same room")
+	assert.Len(t, server.roomsSnapshot(), 1)
+	assert.Len(t, broker.subscribers[roomTopic(first.ID)], 1, "Expected the losing subscription to be dropped")
+}
@@ -1,28 +1,84 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// WsServer holds the state shared by all connections. mutex guards clients,
+// rooms, roomNames, lastSeen and sessions.
 type WsServer struct {
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan []byte
-	rooms      map[*Room]bool
-	mutex      sync.Mutex
+	clients       map[uuid.UUID]*Client
+	register      chan *Client
+	unregister    chan *Client
+	broadcast     chan []byte
+	rooms         map[uuid.UUID]*Room
+	roomNames     map[string]*Room
+	mutex         sync.Mutex
+	media         *MediaStore
+	search        *SearchIndex
+	mentions      *MentionTracker
+	blocks        *BlockList
+	reports       *ReportStore
+	announcements *AnnouncementStore
+	broker        Broker
+	lastSeen      map[uuid.UUID]time.Time
+	sessions      map[uuid.UUID]string
+	ping          chan chan struct{}
+
+	shuttingDown atomic.Bool
+
+	attachmentPolicy AttachmentPolicy
+	defaultRetention RetentionPolicy
+	overflowPolicy   string
+	deletedHistory   string
+	ephemeralRoomTTL time.Duration
 }
 
+// NewWebsocketServer creates a server that runs as a single node.
 func NewWebsocketServer() *WsServer {
-	return &WsServer{
-		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan []byte),
-		rooms:      make(map[*Room]bool),
+	// The in-process broker never fails to subscribe.
+	server, _ := NewWebsocketServerWithBroker(NewLocalBroker())
+	return server
+}
+
+// NewWebsocketServerWithBroker creates a server that shares rooms and
+// presence with the other nodes using broker.
+func NewWebsocketServerWithBroker(broker Broker) (*WsServer, error) {
+	server := &WsServer{
+		clients:       make(map[uuid.UUID]*Client),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		broadcast:     make(chan []byte),
+		rooms:         make(map[uuid.UUID]*Room),
+		roomNames:     make(map[string]*Room),
+		search:        NewSearchIndex(),
+		mentions:      NewMentionTracker(),
+		blocks:        NewBlockList(),
+		reports:       NewReportStore(),
+		announcements: NewAnnouncementStore(),
+		lastSeen:      make(map[uuid.UUID]time.Time),
+		sessions:      make(map[uuid.UUID]string),
+		ping:          make(chan chan struct{}),
+
+		broker: broker,
+
+		attachmentPolicy: defaultAttachmentPolicy(),
+		overflowPolicy:   OverflowDisconnect,
+		deletedHistory:   DeletedHistoryPurge,
+		ephemeralRoomTTL: defaultEphemeralRoomTTL,
 	}
+
+	if _, err := broker.Subscribe(clientsTopic, server.deliverToClients); err != nil {
+		return nil, err
+	}
+
+	return server, nil
 }
 
 func (server *WsServer) Run() {
@@ -30,102 +86,282 @@ func (server *WsServer) Run() {
 		select {
 		case client := <-server.register:
 			server.registerClient(client)
-			log.Printf("Client registered: %v", client)
+			client.logger().Info("Client registered")
 
 		case client := <-server.unregister:
 			server.unregisterClient(client)
-			log.Printf("Client unregistered: %v", client)
+			client.logger().Info("Client unregistered")
 
 		case message := <-server.broadcast:
-			server.broadcastToClients(message)
-			log.Printf("Broadcast message: %v", message)
+			server.publishToClients(nil, message)
+			slog.Debug("Broadcast message", "bytes", len(message))
+
+		case reply := <-server.ping:
+			close(reply)
 
 		}
 	}
 }
 
 func (server *WsServer) registerClient(client *Client) {
-	server.clients[client] = true
-	server.listOnlineClients()
+	server.addClient(client)
+
+	if client.visiblePresence() != PresenceOffline {
+		joinedMsg := &ClientEventMessage{
+			Action: UserJoinedAction,
+			Client: client.summary(),
+		}
+		server.publishToClients(&client.ID, joinedMsg.encode())
+	}
 }
 
 func (server *WsServer) unregisterClient(client *Client) {
 
-	if _, ok := server.clients[client]; ok {
-		delete(server.clients, client)
+	server.mutex.Lock()
+	ok := server.clients[client.ID] == client
+	if ok {
+		delete(server.clients, client.ID)
+		server.lastSeen[client.ID] = time.Now()
+		metrics.ConnectedClients.Set(float64(len(server.clients)))
 	}
-	server.listOnlineClients()
+	server.mutex.Unlock()
 
-}
+	if ok && client.visiblePresence() != PresenceOffline {
+		lastSeen := server.lastSeenAt(client.ID)
+		leftMsg := &ClientEventMessage{
+			Action:   UserLeftAction,
+			Client:   client.summary(),
+			LastSeen: &lastSeen,
+		}
+		server.publishToClients(&client.ID, leftMsg.encode())
+	}
 
-func (server *WsServer) listOnlineClients() {
-	var clientList []*Client
+}
 
-	for otherClient := range server.clients {
-		clientList = append(clientList, otherClient)
+// onlineClients returns the clients the given client should see as online.
+// Invisible clients are left out of everyone's list but their own, and
+// blocked clients out of the list of whoever blocked them.
+func (server *WsServer) onlineClients(client *Client) []*Client {
+	clientList := make([]*Client, 0)
+	for _, otherClient := range server.clientsSnapshot() {
+		if client.hasBlocked(otherClient.ID) {
+			continue
+		}
+		if otherClient == client || otherClient.visiblePresence() != PresenceOffline {
+			clientList = append(clientList, otherClient)
+		}
 	}
 
-	for otherClient := range server.clients {
-		roomListMsg := &ClientsListMessage{
-			Action:      UserJoinedAction,
-			ClientsList: clientList,
-		}
-		otherClient.send <- roomListMsg.encode()
+	return clientList
+}
+
+func (client *Client) handleGetOnlineUsersMessage() {
+	onlineMsg := &ClientsListMessage{
+		Action:      OnlineUsersAction,
+		ClientsList: userSummaries(client.wsServer.onlineClients(client)),
 	}
+	client.enqueue(onlineMsg.encode())
 }
 
-func (server *WsServer) broadcastToClients(message []byte) {
-	for client := range server.clients {
-		client.send <- message
+func (server *WsServer) clientsSnapshot() []*Client {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
 	}
+
+	return clients
+}
+
+// addClient indexes client by its ID. A client that reconnected under the ID
+// of one that has not been unregistered yet replaces it.
+func (server *WsServer) addClient(client *Client) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.clients[client.ID] = client
+	server.sessions[client.ID] = client.token
+	metrics.ConnectedClients.Set(float64(len(server.clients)))
 }
 
 func (server *WsServer) findRoomByName(name string) *Room {
-	var foundRoom *Room
-	for room := range server.rooms {
-		if room.GetName() == name {
-			foundRoom = room
-			break
-		}
-	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 
-	return foundRoom
+	return server.roomNames[name]
 }
 
 func (server *WsServer) findRoomByID(ID string) *Room {
-	var foundRoom *Room
-	for room := range server.rooms {
-		if room.GetId() == ID {
-			foundRoom = room
-			break
-		}
+	id, err := uuid.Parse(ID)
+	if err != nil {
+		return nil
 	}
 
-	return foundRoom
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.rooms[id]
 }
 
+// createRoom creates the room with the given name, or returns the existing
+// one if the name is taken. Room names are unique per server. Rooms created
+// on behalf of a client are ephemeral, rooms without an owner are kept.
 func (server *WsServer) createRoom(name string, private bool, owner *Client) *Room {
-	room := NewRoom(name, private, owner)
-	go room.RunRoom()
-	server.rooms[room] = true
+	for {
+		server.mutex.Lock()
+		if room, ok := server.roomNames[name]; ok {
+			server.mutex.Unlock()
+			return room
+		}
+
+		room := NewRoom(name, private, owner)
+		room.ID = uuid.NewSHA1(roomNamespace, []byte(name))
+		room.Ephemeral = owner != nil
+		// A room that was renamed keeps the ID of its old name, so a new room
+		// with that name derives another one. Nodes that saw the same renames
+		// derive the same ID.
+		for server.rooms[room.ID] != nil {
+			room.ID = uuid.NewSHA1(roomNamespace, room.ID[:])
+		}
+		server.mutex.Unlock()
+
+		// Subscribing may wait on the broker, so it is done without holding
+		// the lock. If another room took the name or ID in the meantime, that
+		// one is used instead or this one gets a new ID.
+		server.subscribeRoom(room)
+
+		server.mutex.Lock()
+		if server.roomNames[name] == nil && server.rooms[room.ID] == nil {
+			go room.RunRoom()
+			server.indexRoom(room)
+			server.mutex.Unlock()
+			return room
+		}
+		server.mutex.Unlock()
+
+		if room.unsubscribe != nil {
+			room.unsubscribe()
+		}
+	}
+}
+
+// addRoom indexes a room that was created elsewhere, such as in tests.
+func (server *WsServer) addRoom(room *Room) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.indexRoom(room)
+}
+
+func (server *WsServer) indexRoom(room *Room) {
+	server.rooms[room.ID] = room
+	server.roomNames[room.GetName()] = room
+	metrics.Rooms.Set(float64(len(server.rooms)))
+}
+
+// renameRoom gives room a new name, unless another room already uses it.
+func (server *WsServer) renameRoom(room *Room, name string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if other, ok := server.roomNames[name]; ok && other != room {
+		return false
+	}
+	if server.roomNames[room.GetName()] == room {
+		delete(server.roomNames, room.GetName())
+	}
+	room.setName(name)
+	server.roomNames[name] = room
 
-	return room
+	return true
 }
 
+// deleteRoom removes room from the server, stops its loop, which tells the
+// members it is gone, and discards its history.
 func (server *WsServer) deleteRoom(room *Room) {
-	delete(server.rooms, room)
+	server.mutex.Lock()
+	if server.rooms[room.ID] == room {
+		delete(server.rooms, room.ID)
+	}
+	if server.roomNames[room.GetName()] == room {
+		delete(server.roomNames, room.GetName())
+	}
+	metrics.Rooms.Set(float64(len(server.rooms)))
+	server.mutex.Unlock()
+
+	if room.unsubscribe != nil {
+		room.unsubscribe()
+	}
+	room.stop()
+
+	server.discardRoomHistory(room)
 }
 
-func (server *WsServer) findClientByID(ID string) *Client {
-	var foundClient *Client
-	for client := range server.clients {
-		if client.ID.String() == ID {
-			foundClient = client
-			break
+// sendRoomLists sends every connected client the rooms it can see, after
+// rooms were added, renamed or removed.
+func (server *WsServer) sendRoomLists() {
+	for _, client := range server.clientsSnapshot() {
+		roomListMsg := &RoomListMessage{
+			Action:   "room-list",
+			RoomList: roomSummaries(server.getAllRooms(client)),
 		}
+		client.enqueue(roomListMsg.encode())
 	}
+}
+
+func (server *WsServer) roomsSnapshot() []*Room {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 
-	return foundClient
+	rooms := make([]*Room, 0, len(server.rooms))
+	for _, room := range server.rooms {
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+func (server *WsServer) findClientByID(ID string) *Client {
+	id, err := uuid.Parse(ID)
+	if err != nil {
+		return nil
+	}
+
+	return server.clientByID(id)
+}
+
+func (server *WsServer) clientByID(id uuid.UUID) *Client {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.clients[id]
+}
+
+func (server *WsServer) hasClient(client *Client) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.clients[client.ID] == client
+}
+
+func (server *WsServer) isOnline(id uuid.UUID) bool {
+	return server.clientByID(id) != nil
+}
+
+// restoreSeats puts a reconnecting client back in the private rooms it was
+// in when it disconnected, unless it has been banned from them since.
+func (server *WsServer) restoreSeats(client *Client) {
+	for _, room := range server.roomsSnapshot() {
+		if room.isBanned(client.ID) {
+			room.releaseSeat(client.ID)
+			continue
+		}
+		if room.takeSeat(client) {
+			client.addRoom(room)
+		}
+	}
 }
 
 func (server *WsServer) getAllRooms(client *Client) []*Room {
@@ -134,14 +370,14 @@ func (server *WsServer) getAllRooms(client *Client) []*Room {
 
 	rooms := make([]*Room, 0, len(server.rooms))
 
-	for room := range server.rooms {
-		if !room.Private || (room.Private && room.clients[client]) {
+	for _, room := range server.rooms {
+		if !room.Private || (room.Private && room.hasClient(client)) {
 			rooms = append(rooms, room)
 		}
 	}
 
 	sort.Slice(rooms, func(i, j int) bool {
-		return rooms[i].Name < rooms[j].Name
+		return rooms[i].GetName() < rooms[j].GetName()
 	})
 
 	return rooms
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
 	"testing"
 
@@ -34,7 +35,7 @@ func TestRegisterClient(t *testing.T) {
 	server := NewWebsocketServer()
 	client := &Client{}
 	server.registerClient(client)
-	if _, ok := server.clients[client]; !ok {
+	if !server.hasClient(client) {
 		t.Error("Expected client to be registered")
 	}
 }
@@ -42,9 +43,9 @@ func TestRegisterClient(t *testing.T) {
 func TestUnregisterClient(t *testing.T) {
 	server := NewWebsocketServer()
 	client := &Client{}
-	server.clients[client] = true
+	server.addClient(client)
 	server.unregisterClient(client)
-	if _, ok := server.clients[client]; ok {
+	if server.hasClient(client) {
 		t.Error("Expected client to be unregistered")
 	}
 }
@@ -53,7 +54,7 @@ func TestFindRoomByName(t *testing.T) {
 	server := NewWebsocketServer()
 	room := &Room{}
 	room.Name = "test"
-	server.rooms[room] = true
+	server.addRoom(room)
 	foundRoom := server.findRoomByName("test")
 	if foundRoom != room {
 		t.Error("Expected to find the room")
@@ -65,7 +66,7 @@ func TestFindRoomByID(t *testing.T) {
 	room := &Room{}
 	id := uuid.New()
 	room.ID = id
-	server.rooms[room] = true
+	server.addRoom(room)
 	foundRoom := server.findRoomByID(id.String())
 	if foundRoom != room {
 		t.Error("Expected to find the room")
@@ -78,7 +79,7 @@ func TestCreateRoom(t *testing.T) {
 	if room == nil {
 		t.Error("Expected a new Room instance, got nil")
 	}
-	if _, ok := server.rooms[room]; !ok {
+	if server.rooms[room.ID] != room {
 		t.Error("Expected room to be added to the server's rooms")
 	}
 }
@@ -88,7 +89,7 @@ func TestFindClientByID(t *testing.T) {
 	client := &Client{}
 	id := uuid.New()
 	client.ID = id
-	server.clients[client] = true
+	server.addClient(client)
 	foundClient := server.findClientByID(id.String())
 	if foundClient != client {
 		t.Error("Expected to find the client")
@@ -97,10 +98,10 @@ func TestFindClientByID(t *testing.T) {
 
 func TestGetAllRooms(t *testing.T) {
 	server := NewWebsocketServer()
-	room1 := &Room{}
-	room2 := &Room{}
-	server.rooms[room1] = true
-	server.rooms[room2] = true
+	room1 := &Room{ID: uuid.New(), Name: "room1"}
+	room2 := &Room{ID: uuid.New(), Name: "room2"}
+	server.addRoom(room1)
+	server.addRoom(room2)
 	rooms := server.getAllRooms(newClient(nil, nil, "test"))
 	if len(rooms) != 2 {
 		t.Errorf("Expected 2 rooms, got %d", len(rooms))
@@ -126,3 +127,112 @@ func TestGetAllRoomsConcurrent(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestRegisterClient_NotifiesOtherClients(t *testing.T) {
+	server := NewWebsocketServer()
+	existing := newClient(nil, server, "existing")
+	server.addClient(existing)
+	joining := newClient(nil, server, "joining")
+
+	server.registerClient(joining)
+
+	if len(joining.send) != 0 {
+		t.Error("Expected the joining client not to be sent its own join")
+	}
+	var joined ClientEventMessage
+	if err := json.Unmarshal(<-existing.send, &joined); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	if joined.Action != UserJoinedAction || joined.Client.ID != joining.ID {
+		t.Errorf("Expected a %s event for the joining client, got %s", UserJoinedAction, joined.Action)
+	}
+}
+
+func TestHandleGetOnlineUsersMessage(t *testing.T) {
+	server := NewWebsocketServer()
+	first := newClient(nil, server, "first")
+	second := newClient(nil, server, "second")
+	server.addClient(first)
+	server.addClient(second)
+
+	first.handleGetOnlineUsersMessage()
+
+	var list ClientsListMessage
+	if err := json.Unmarshal(<-first.send, &list); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	if list.Action != OnlineUsersAction {
+		t.Errorf("Expected action %s, got %s", OnlineUsersAction, list.Action)
+	}
+	if len(list.ClientsList) != 2 {
+		t.Errorf("Expected 2 online clients, got %d", len(list.ClientsList))
+	}
+}
+
+func TestCreateRoom_NamesAreUnique(t *testing.T) {
+	server := NewWebsocketServer()
+	room := server.createRoom("test", false, nil)
+
+	if server.createRoom("test", true, nil) != room {
+		t.Error("Expected the existing room to be returned")
+	}
+	if len(server.roomsSnapshot()) != 1 {
+		t.Errorf("Expected 1 room, got %d", len(server.roomsSnapshot()))
+	}
+}
+
+func TestRenameRoom_UpdatesIndexes(t *testing.T) {
+	server := NewWebsocketServer()
+	room := server.createRoom("old", false, nil)
+	other := server.createRoom("other", false, nil)
+
+	if server.renameRoom(room, "other") {
+		t.Error("Expected renaming to a taken name to fail")
+	}
+	if !server.renameRoom(room, "new") {
+		t.Fatal("Expected the room to be renamed")
+	}
+	if server.findRoomByName("old") != nil || server.findRoomByName("new") != room {
+		t.Error("Expected the room to be found by its new name only")
+	}
+
+	// The renamed room keeps the ID derived from "old", so a new room with
+	// that name needs another one.
+	recreated := server.createRoom("old", false, nil)
+	if recreated == room || recreated.ID == room.ID {
+		t.Error("Expected a new room with its own ID")
+	}
+	if server.findRoomByID(room.ID.String()) != room || server.findRoomByID(recreated.ID.String()) != recreated {
+		t.Error("Expected both rooms to be found by ID")
+	}
+
+	server.deleteRoom(other)
+	if server.findRoomByName("other") != nil || server.findRoomByID(other.ID.String()) != nil {
+		t.Error("Expected the deleted room to be removed from both indexes")
+	}
+}
+
+func TestFindByID_InvalidID(t *testing.T) {
+	server := NewWebsocketServer()
+	if server.findRoomByID("not-a-uuid") != nil {
+		t.Error("Expected no room for an invalid ID")
+	}
+	if server.findClientByID("not-a-uuid") != nil {
+		t.Error("Expected no client for an invalid ID")
+	}
+}
+
+func TestUnregisterClient_KeepsReplacement(t *testing.T) {
+	server := NewWebsocketServer()
+	stale := newClient(nil, server, "test")
+	replacement := newClient(nil, server, "test")
+	replacement.ID = stale.ID
+
+	server.addClient(stale)
+	server.addClient(replacement)
+	server.unregisterClient(stale)
+
+	if server.findClientByID(stale.ID.String()) != replacement {
+		t.Error("Expected the replacement client to stay registered")
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,12 +44,38 @@ type Client struct {
 	Name        string    `json:"name"`
 	rooms       map[*Room]bool
 	RoomsIds    []uuid.UUID `json:"rooms"`
-	isTyping    bool
-	mu          sync.Mutex
-	AvatarColor string `json:"avatarColor"`
+	AvatarColor string      `json:"avatarColor"`
+	Presence    string      `json:"presence"`
+
+	// token authenticates the client's HTTP requests and is only ever sent
+	// to the client itself.
+	token string
+
+	// connMu guards conn and stop, which change when the client reconnects.
+	connMu sync.Mutex
+	stop   chan struct{}
+
+	// roomsMu guards rooms and RoomsIds.
+	roomsMu sync.Mutex
+
+	overflow     string
+	evicted      atomic.Bool
+	pendingMu    sync.Mutex
+	pending      map[string][]byte
+	pendingReady chan struct{}
+
+	presenceMu   sync.Mutex
+	status       string
+	idle         bool
+	lastActivity time.Time
+	lastPong     time.Time
+
+	typingMu sync.Mutex
+	typing   map[uuid.UUID]*typingState
 }
 
-func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
+// avatarColors are the colors clients and rooms are shown with.
+var avatarColors = func() []string {
 	colors := []string{}
 	prefixes := []string{
 		"red",
@@ -71,6 +98,26 @@ func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
 			colors = append(colors, color)
 		}
 	}
+
+	return colors
+}()
+
+func isAvatarColor(color string) bool {
+	for _, avatarColor := range avatarColors {
+		if avatarColor == color {
+			return true
+		}
+	}
+	return false
+}
+
+func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
+	overflow := OverflowDisconnect
+	if wsServer != nil {
+		overflow = wsServer.overflowPolicy
+	}
+
+	now := time.Now()
 	return &Client{
 		ID:          uuid.New(),
 		Name:        name,
@@ -79,159 +126,285 @@ func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
 		send:        make(chan []byte, 256),
 		rooms:       make(map[*Room]bool),
 		RoomsIds:    make([]uuid.UUID, 0),
-		AvatarColor: colors[rand.Intn(len(colors))],
+		AvatarColor: avatarColors[rand.Intn(len(avatarColors))],
+		Presence:    PresenceOnline,
+		token:       newSessionToken(),
+
+		status:       PresenceOnline,
+		lastActivity: now,
+		lastPong:     now,
+
+		typing: make(map[uuid.UUID]*typingState),
+
+		overflow:     overflow,
+		pending:      make(map[string][]byte),
+		pendingReady: make(chan struct{}, 1),
 	}
 
 }
 
-func (client *Client) readPump() {
+// summary describes the client for other clients.
+func (client *Client) summary() UserSummary {
+	return UserSummary{
+		ID:          client.ID,
+		Name:        client.Name,
+		AvatarColor: client.AvatarColor,
+		Presence:    client.visiblePresence(),
+	}
+}
+
+// MarshalJSON encodes the client's summary.
+func (client *Client) MarshalJSON() ([]byte, error) {
+	return json.Marshal(client.summary())
+}
+
+func (client *Client) readPump(conn *websocket.Conn) {
 	defer func() {
-		client.disconnect()
+		// A client that reconnected keeps its rooms, only the replaced
+		// connection goes away.
+		if client.connection() == conn {
+			client.disconnect()
+		} else {
+			conn.Close()
+		}
 	}()
 
-	client.conn.SetReadLimit(maxMessageSize)
-	client.conn.SetReadDeadline(time.Now().Add(pongWait))
-	client.conn.SetPongHandler(func(string) error { client.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		client.touchPong()
+		return nil
+	})
 
 	for {
-		_, jsonMessage, err := client.conn.ReadMessage()
+		_, jsonMessage, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("unexpected close error: %v", err)
+				client.logger().Warn("Unexpected close error", "error", err)
 			}
 			break
 		}
 
+		metrics.MessageBytes.Add("in", float64(len(jsonMessage)))
 		client.handleNewMessage(jsonMessage)
 	}
 
 }
 
-func (client *Client) writePump() {
+func (client *Client) writePump(conn *websocket.Conn, stop <-chan struct{}) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
-		client.conn.Close()
+		conn.Close()
 	}()
 	for {
 		select {
+		case <-stop:
+			return
+
 		case message, ok := <-client.send:
-			client.mu.Lock()
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := client.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := client.writeBatch(conn, append([][]byte{message}, client.drainQueued()...)); err != nil {
 				return
 			}
-			w.Write(message)
-
-			n := len(client.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-client.send)
-			}
 
-			if err := w.Close(); err != nil {
+		case <-client.pendingReady:
+			// Coalesced messages are newer than anything still queued, so
+			// the queue is written first.
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.writeBatch(conn, append(client.drainQueued(), client.takePending()...)); err != nil {
 				return
 			}
-			client.mu.Unlock()
 
 		case <-ticker.C:
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// drainQueued takes the messages that are already waiting in the send
+// buffer.
+func (client *Client) drainQueued() [][]byte {
+	n := len(client.send)
+	messages := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		messages = append(messages, <-client.send)
+	}
+
+	return messages
+}
+
+// writeBatch writes messages as one newline separated WebSocket message.
+func (client *Client) writeBatch(conn *websocket.Conn, messages [][]byte) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		metrics.SendsDropped.Add("write-error", float64(len(messages)))
+		return err
+	}
+
+	written := 0
+	for i, message := range messages {
+		if i > 0 {
+			w.Write(newline)
+			written += len(newline)
+		}
+		w.Write(message)
+		written += len(message)
+	}
+
+	if err := w.Close(); err != nil {
+		metrics.SendsDropped.Add("write-error", float64(len(messages)))
+		return err
+	}
+	metrics.MessageBytes.Add("out", float64(written))
+
+	return nil
+}
+
+// attach makes conn the client's connection and starts its pumps. The
+// connection it replaces, if any, is closed and its pumps stop.
+func (client *Client) attach(conn *websocket.Conn) {
+	stop := make(chan struct{})
+
+	client.connMu.Lock()
+	previous, previousStop := client.conn, client.stop
+	client.conn, client.stop = conn, stop
+	client.connMu.Unlock()
+	client.evicted.Store(false)
+
+	if previousStop != nil {
+		close(previousStop)
+	}
+	if previous != nil {
+		previous.Close()
+	}
+
+	go client.writePump(conn, stop)
+	go client.readPump(conn)
+}
+
+func (client *Client) connection() *websocket.Conn {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+
+	return client.conn
+}
+
+// close ends the client's connection. Its read pump then sees the error and
+// disconnects it like any other client that went away.
+func (client *Client) close() {
+	if conn := client.connection(); conn != nil {
+		conn.Close()
+	}
+}
+
 func (client *Client) disconnect() {
 	/* for room := range client.rooms {
-		room.unregister <- client
+		room.leave(client)
 	} */
 	/* close(client.send)
 	client.conn.Close()
 	*/
-	hasPrivateRoom := false
-	for room := range client.rooms {
-		if !room.Private {
-			room.unregister <- client
+	client.stopAllTyping()
+
+	// Private rooms cannot be joined again by name, so the client keeps its
+	// place in them until it reconnects.
+	for _, room := range client.roomsSnapshot() {
+		if room.Private {
+			room.keepSeat(client)
 		} else {
-			hasPrivateRoom = true
+			room.leave(client)
 		}
 	}
-	if !hasPrivateRoom {
-		client.wsServer.unregister <- client
-	}
-	client.conn.Close()
+	client.wsServer.unregister <- client
+	client.close()
 }
 
 func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 	name, ok := r.URL.Query()["name"]
 	if !ok || len(name[0]) < 1 {
-		log.Println("Url Param 'name' is missing")
+		slog.Warn("Url param 'name' is missing", "remoteAddr", r.RemoteAddr)
 		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		metrics.UpgradeFailures.Inc()
+		slog.Warn("WebSocket upgrade failed", "remoteAddr", r.RemoteAddr, "error", err)
 		return
 	}
 
-	id, ok := r.URL.Query()["id"]
 	var client *Client
-	if ok && len(id[0]) > 0 {
-		client = wsServer.findClientByID(id[0])
-		if client != nil {
-			client.conn = conn
-			go client.writePump()
-			go client.readPump()
-		} else {
-			client = newClient(conn, wsServer, name[0])
-			go client.writePump()
-			go client.readPump()
+	previousID, resumed := wsServer.resumeSession(r.URL.Query().Get("id"), r.URL.Query().Get("token"))
+	if resumed {
+		client = wsServer.clientByID(previousID)
+	} else if r.URL.Query().Has("id") {
+		slog.Warn("Rejected reconnect without a valid session token", "remoteAddr", r.RemoteAddr)
+	}
+	if client == nil {
+		client = newClient(nil, wsServer, name[0])
+		if resumed {
+			client.ID = previousID
+			client.token = r.URL.Query().Get("token")
+			wsServer.restoreSeats(client)
+		}
+		if overflow := r.URL.Query().Get("overflow"); isOverflowPolicy(overflow) {
+			client.overflow = overflow
 		}
-	} else {
-		client = newClient(conn, wsServer, name[0])
-		go client.writePump()
-		go client.readPump()
 	}
+	client.attach(conn)
 
 	roomListMsg := &RoomListMessage{
 		Action:   "room-list",
-		RoomList: wsServer.getAllRooms(client),
+		RoomList: roomSummaries(wsServer.getAllRooms(client)),
 	}
-	client.send <- roomListMsg.encode()
+	client.enqueue(roomListMsg.encode())
 
-	message := &Message{
+	loggedInMsg := &LoggedInMessage{
 		Action: UserLoggedInAction,
-		Sender: client,
+		Sender: client.summary(),
+		Token:  client.token,
 	}
-	client.send <- message.encode()
+	client.enqueue(loggedInMsg.encode())
+	client.sendUnreadMentions()
+	client.sendBlockedUsers()
+	client.sendAnnouncements()
 
-	if _, ok := wsServer.clients[client]; !ok {
+	if !wsServer.hasClient(client) {
 		wsServer.register <- client
 	}
-	wsServer.listOnlineClients()
 }
 
 func (client *Client) handleNewMessage(jsonMessage []byte) {
 	var message Message
 	if err := json.Unmarshal(jsonMessage, &message); err != nil {
-		log.Printf("Error on unmarshal JSON message: %s\nReceived message: %s", err, string(jsonMessage))
+		client.logger().Warn("Error on unmarshal JSON message", "error", err, "bytes", len(jsonMessage))
 		return
 	}
 
 	currentTime := time.Now()
 	currentHour, currentMinute, _ := currentTime.Clock()
 	message.Timestamp = fmt.Sprintf("%d:%02d", currentHour, currentMinute)
+	message.CreatedAt = currentTime
+	message.ID = uuid.New()
 	message.Sender = client
 
+	client.touch()
+
+	action := message.Action
 	switch message.Action {
 	case JoinRoomAction:
 		client.handleJoinRoomMessage(message)
@@ -248,51 +421,168 @@ func (client *Client) handleNewMessage(jsonMessage []byte) {
 	case DeleteRoomAction:
 		client.handleDeleteRoomAcion(message)
 
+	case UpdateRoomAction:
+		client.handleUpdateRoomMessage(message)
+
+	case RenameRoomAction:
+		client.handleRenameRoomMessage(message)
+
+	case CreateDMAction:
+		client.handleCreateDMMessage(message)
+
+	case AddDMParticipantsAction:
+		client.handleAddDMParticipantsMessage(message)
+
 	case SendMessageAction:
 		client.handleTextMessage(&message)
 
 	case SendAudioMessageAction:
 		client.handleAudioMessage(&message)
+
+	case SetRetentionAction:
+		client.handleSetRetentionMessage(message)
+
+	case SetFiltersAction:
+		client.handleSetFiltersMessage(message)
+
+	case ReportMessageAction:
+		client.handleReportMessage(message)
+
+	case SearchMessagesAction:
+		client.handleSearchMessage(message)
+
+	case MarkMentionsReadAction:
+		client.handleMarkMentionsReadMessage(message)
+
+	case SetPresenceAction:
+		client.handleSetPresenceMessage(message)
+
+	case GetOnlineUsersAction:
+		client.handleGetOnlineUsersMessage()
+
+	case BlockUserAction:
+		client.handleBlockUserMessage(message)
+
+	case UnblockUserAction:
+		client.handleUnblockUserMessage(message)
+
+	default:
+		action = "unknown"
 	}
+	metrics.InboundActions.Inc(action)
+	client.logger().Debug("Handled message", "action", message.Action, "bytes", len(jsonMessage))
 }
 
 func (client *Client) handleTextMessage(message *Message) {
+	// attachmentId is a shorthand for a single attachment, so it is held to
+	// the same policy and counts towards the same limit.
+	requested := message.Attachments
+	if message.AttachmentID != "" {
+		requested = append([]Attachment{{BlobID: message.AttachmentID}}, requested...)
+	}
+	if len(requested) > 0 {
+		attachments, err := client.wsServer.resolveAttachments(requested)
+		if err != nil {
+			client.logger().Warn("Rejected attachments", "action", message.Action, "error", err)
+			return
+		}
+		if message.AttachmentID != "" {
+			attachments = attachments[1:]
+		}
+		message.Attachments = attachments
+	}
+
+	if message.Target == nil {
+		return
+	}
+
 	roomID := message.Target.GetId()
 	if room := client.wsServer.findRoomByID(roomID); room != nil {
-		room.Messages = append(room.Messages, *message)
-		room.broadcast <- message
+		if room.isBanned(client.ID) {
+			client.sendError(message.Action, room, errBannedFromRoom)
+			return
+		}
+		if !room.hasClient(client) {
+			client.sendError(message.Action, room, errNotRoomMember)
+			return
+		}
+		// Only the ID is taken from the client, the rest of the target is the
+		// room as the server knows it.
+		message.Target = room
+
+		text, err := room.filter(message.Message)
+		if err != nil {
+			client.logger().Warn("Rejected message", roomAttr(room), "action", message.Action, "error", err)
+			client.sendError(message.Action, room, err)
+			return
+		}
+		message.Message = text
+
+		client.stopTyping(room.ID)
+		message.Mentions = client.wsServer.resolveMentions(room, message.Message, client)
+		room.storeMessage(*message)
+		client.wsServer.search.Add(message, room)
+		room.send(message)
+		client.wsServer.notifyMentions(message)
 	}
 }
 
 func (client *Client) handleAudioMessage(message *Message) {
 	audioData, err := base64.StdEncoding.DecodeString(message.Message)
 	if err != nil {
-		log.Printf("Error decoding base64 audio message: %s", err)
+		client.logger().Warn("Error decoding base64 audio message", "action", message.Action, "error", err)
+		return
+	}
+
+	info, err := validateAudio(audioData)
+	if err != nil {
+		client.logger().Warn("Rejected audio message", "action", message.Action, "error", err)
 		return
 	}
 
 	message.AudioData = audioData
-	message.Action = SendMessageAction
+	message.Message = ""
+	message.Action = AudioMessageAction
+	message.MimeType = info.MimeType
+	message.DurationMs = info.Duration.Milliseconds()
+
+	if message.Target == nil {
+		return
+	}
 
 	roomID := message.Target.GetId()
 	if room := client.wsServer.findRoomByID(roomID); room != nil {
-		room.Messages = append(room.Messages, *message)
-		room.broadcast <- message
+		if room.isBanned(client.ID) {
+			client.sendError(message.Action, room, errBannedFromRoom)
+			return
+		}
+		if !room.hasClient(client) {
+			client.sendError(message.Action, room, errNotRoomMember)
+			return
+		}
+		message.Target = room
+
+		room.storeMessage(*message)
+		room.send(message)
 	}
 }
 func (client *Client) handleDeleteRoomAcion(message Message) {
+	if message.Target == nil {
+		return
+	}
+
 	room := client.wsServer.findRoomByID(message.Target.GetId())
 	if room == nil {
 		return
 	}
-	client.wsServer.deleteRoom(room)
-	roomListMsg := &RoomListMessage{
-		Action:   "room-list",
-		RoomList: client.wsServer.getAllRooms(client),
-	}
-	for otherClients := range client.wsServer.clients {
-		otherClients.send <- roomListMsg.encode()
+
+	if !room.isPrivileged(client) {
+		client.logger().Warn("Client is not allowed to delete room", roomAttr(room), "action", message.Action)
+		return
 	}
+
+	client.wsServer.deleteRoom(room)
+	client.wsServer.sendRoomLists()
 }
 
 func (client *Client) handleJoinRoomMessage(message Message) {
@@ -308,9 +598,9 @@ func (client *Client) handleLeaveRoomMessage(message Message) {
 		return
 	}
 
-	delete(client.rooms, room)
+	client.removeRoom(room)
 
-	room.unregister <- client
+	room.leave(client)
 
 }
 func (client *Client) handleJoinRoomPrivateMessageSimple(message Message) {
@@ -321,7 +611,12 @@ func (client *Client) handleJoinRoomPrivateMessageSimple(message Message) {
 		return
 	}
 
-	roomName := message.Message + client.ID.String()
+	if target.hasBlocked(client.ID) {
+		client.logger().Warn("Client is blocked by the user", "action", message.Action, "userId", target.ID)
+		return
+	}
+
+	roomName := dmRoomName([]uuid.UUID{client.ID, target.ID})
 
 	client.joinRoom(roomName, target, true)
 	target.joinRoom(roomName, client, true)
@@ -329,38 +624,45 @@ func (client *Client) handleJoinRoomPrivateMessageSimple(message Message) {
 }
 
 func (client *Client) joinRoom(roomName string, sender *Client, private bool) {
+	if !private && isDirectMessageName(roomName) {
+		client.logger().Warn("Room name is reserved for direct messages", "name", roomName)
+		return
+	}
+
 	room := client.wsServer.findRoomByName(roomName)
 	if room == nil {
 		room = client.wsServer.createRoom(roomName, private, sender)
-		for otherClients := range client.wsServer.clients {
-			roomListMsg := &RoomListMessage{
-				Action:   "room-list",
-				RoomList: client.wsServer.getAllRooms(client),
-			}
-			otherClients.send <- roomListMsg.encode()
-		}
+		client.wsServer.sendRoomLists()
 
 	}
 
-	if sender == nil && room.Private && !room.clients[client] {
+	if (sender == nil || !private) && room.Private && !room.hasClient(client) {
 		return
 	}
 
-	room.registerClientInRoom(sender)
-
-	if !client.isInRoom(room) {
+	if room.isBanned(client.ID) {
+		client.logger().Warn("Client is banned from the room", roomAttr(room))
+		return
+	}
 
-		client.rooms[room] = true
+	if sender != nil && sender != client {
+		room.join(sender)
+	}
 
+	client.addRoom(room)
+	if !room.join(client) {
+		client.removeRoom(room)
+		return
 	}
-	room.register <- client
 
-	client.getRoomClients(room)
 	client.notifyRoomJoined(room, sender)
 
 }
 
 func (client *Client) isInRoom(room *Room) bool {
+	client.roomsMu.Lock()
+	defer client.roomsMu.Unlock()
+
 	if _, ok := client.rooms[room]; ok {
 		return true
 	}
@@ -368,27 +670,60 @@ func (client *Client) isInRoom(room *Room) bool {
 	return false
 }
 
-func (client *Client) notifyRoomJoined(room *Room, sender *Client) {
-	message := Message{
-		Action: RoomJoinedAction,
-		Target: room,
-		Sender: sender,
-	}
+func (client *Client) addRoom(room *Room) {
+	client.roomsMu.Lock()
+	defer client.roomsMu.Unlock()
 
-	client.send <- message.encode()
+	if !client.rooms[room] {
+		client.rooms[room] = true
+		client.RoomsIds = append(client.RoomsIds, room.ID)
+	}
 }
 
-func (client *Client) GetName() string {
-	return client.Name
+func (client *Client) removeRoom(room *Room) {
+	client.roomsMu.Lock()
+	defer client.roomsMu.Unlock()
+
+	if !client.rooms[room] {
+		return
+	}
+	delete(client.rooms, room)
+	for i, id := range client.RoomsIds {
+		if id == room.ID {
+			client.RoomsIds = append(client.RoomsIds[:i], client.RoomsIds[i+1:]...)
+			break
+		}
+	}
 }
 
-func (client *Client) SetTyping(message Message) {
-	client.isTyping = message.Message == "true"
+func (client *Client) roomsSnapshot() []*Room {
+	client.roomsMu.Lock()
+	defer client.roomsMu.Unlock()
 
-	message.Sender = client
+	rooms := make([]*Room, 0, len(client.rooms))
 	for room := range client.rooms {
-		room.broadcast <- &message
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+func (client *Client) notifyRoomJoined(room *Room, sender *Client) {
+	message := RoomJoinedMessage{
+		Action:   RoomJoinedAction,
+		Target:   room.summary(),
+		Messages: messageViews(client.withoutBlocked(room.history())),
+	}
+	if sender != nil {
+		summary := sender.summary()
+		message.Sender = &summary
 	}
+
+	client.enqueue(message.encode())
+}
+
+func (client *Client) GetName() string {
+	return client.Name
 }
 
 func contains(slice []uuid.UUID, item uuid.UUID) bool {
@@ -399,16 +734,3 @@ func contains(slice []uuid.UUID, item uuid.UUID) bool {
 	}
 	return false
 }
-
-func (client *Client) getRoomClients(room *Room) {
-
-	for otherClient := range room.clients {
-
-		roomListMsg := &RoomClientsListMessage{
-			Action:          "room-clients-list",
-			RoomClientsList: room.Clients,
-		}
-		otherClient.send <- roomListMsg.encode()
-
-	}
-}
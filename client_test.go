@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRegisterClientSuccessfully(t *testing.T) {
@@ -17,7 +26,191 @@ func TestRegisterClientSuccessfully(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	if _, exists := server.clients[client]; !exists {
+	if !server.hasClient(client) {
 		t.Errorf("Expected client to be registered, but it was not")
 	}
 }
+
+// TestServeWs_ConcurrentClients runs several real clients against one server
+// at the same time. It is mostly useful under "go test -race".
+func TestServeWs_ConcurrentClients(t *testing.T) {
+	const clientCount = 8
+	const messagesPerClient = 5
+
+	server := NewWebsocketServer()
+	go server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(server, w, r)
+	}))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	type testClient struct {
+		conn     *websocket.Conn
+		mu       sync.Mutex
+		roomID   string
+		received int
+		joined   chan struct{}
+	}
+
+	clients := make([]*testClient, clientCount)
+	var readers sync.WaitGroup
+	for i := range clients {
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?name=user%d", wsURL, i), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		client := &testClient{conn: conn, joined: make(chan struct{})}
+		clients[i] = client
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				_, data, err := client.conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				for _, line := range strings.Split(string(data), "\n") {
+					var message struct {
+						Action string `json:"action"`
+						Target *struct {
+							ID string `json:"id"`
+						} `json:"target"`
+					}
+					if json.Unmarshal([]byte(line), &message) != nil {
+						continue
+					}
+
+					client.mu.Lock()
+					switch message.Action {
+					case RoomJoinedAction:
+						if client.roomID == "" {
+							client.roomID = message.Target.ID
+							close(client.joined)
+						}
+					case SendMessageAction:
+						client.received++
+					}
+					client.mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for _, client := range clients {
+		writers.Add(1)
+		go func(client *testClient) {
+			defer writers.Done()
+			client.conn.WriteJSON(map[string]interface{}{"action": JoinRoomAction, "message": "general"})
+			client.conn.WriteJSON(map[string]interface{}{"action": GetOnlineUsersAction})
+		}(client)
+	}
+	writers.Wait()
+
+	for _, client := range clients {
+		select {
+		case <-client.joined:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected every client to join the room")
+		}
+	}
+
+	// Rooms can only be looked up once they were joined, so wait until every
+	// member is registered before sending.
+	room := server.findRoomByName("general")
+	require.NotNil(t, room)
+	require.Eventually(t, func() bool {
+		return room.memberCount() == clientCount
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, client := range clients {
+		writers.Add(1)
+		go func(client *testClient) {
+			defer writers.Done()
+			target := map[string]interface{}{"id": client.roomID}
+			for i := 0; i < messagesPerClient; i++ {
+				client.conn.WriteJSON(map[string]interface{}{"action": TypingAction, "message": "true", "target": target})
+				client.conn.WriteJSON(map[string]interface{}{"action": SendMessageAction, "message": fmt.Sprintf("hello @user%d", i), "target": target})
+				client.conn.WriteJSON(map[string]interface{}{"action": SearchMessagesAction, "search": map[string]interface{}{"query": "hello"}})
+			}
+			client.conn.WriteJSON(map[string]interface{}{"action": SetPresenceAction, "message": PresenceDoNotDisturb})
+		}(client)
+	}
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			server.stats()
+			server.getAllRooms(nil)
+			server.sendRoomLists()
+		}
+	}()
+
+	writers.Wait()
+
+	for _, client := range clients {
+		require.Eventually(t, func() bool {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.received == clientCount*messagesPerClient
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	for _, client := range clients {
+		client.conn.Close()
+	}
+	readers.Wait()
+
+	assert.Eventually(t, func() bool {
+		return len(server.clientsSnapshot()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServeWs_ReconnectNeedsSessionToken(t *testing.T) {
+	server := NewWebsocketServer()
+	go server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(server, w, r)
+	}))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	// login connects and returns what the server sent in user-logged-in.
+	login := func(query string) (*websocket.Conn, LoggedInMessage) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+query, nil)
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			require.NoError(t, err)
+			for _, line := range strings.Split(string(data), "\n") {
+				var loggedIn LoggedInMessage
+				if json.Unmarshal([]byte(line), &loggedIn) == nil && loggedIn.Action == UserLoggedInAction {
+					return conn, loggedIn
+				}
+			}
+		}
+	}
+
+	conn, alice := login("name=alice")
+	require.NotEmpty(t, alice.Token)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return !server.isOnline(alice.Sender.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, query := range []string{
+		"name=mallory&id=" + alice.Sender.ID.String(),
+		"name=mallory&id=" + alice.Sender.ID.String() + "&token=" + newSessionToken(),
+	} {
+		conn, mallory := login(query)
+		assert.NotEqual(t, alice.Sender.ID, mallory.Sender.ID, "Expected a reconnect without alice's token to get a new ID")
+		conn.Close()
+	}
+
+	conn, again := login("name=alice&id=" + alice.Sender.ID.String() + "&token=" + alice.Token)
+	defer conn.Close()
+	assert.Equal(t, alice.Sender.ID, again.Sender.ID)
+	assert.Equal(t, alice.Token, again.Token)
+}
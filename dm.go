@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// dmRoomPrefix starts the name of every direct message room. Names with
+	// it are reserved, so other rooms cannot take a conversation's name.
+	dmRoomPrefix      = "dm:"
+	maxDMParticipants = 16
+)
+
+func isDirectMessageName(name string) bool {
+	return strings.HasPrefix(name, dmRoomPrefix)
+}
+
+// dmRoomName returns the name of the direct message room for a set of
+// participants. It does not depend on their order, so the same people always
+// end up in the same room whoever starts the conversation.
+func dmRoomName(participants []uuid.UUID) string {
+	ids := make([]string, 0, len(participants))
+	seen := make(map[uuid.UUID]bool)
+	for _, id := range participants {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id.String())
+		}
+	}
+	sort.Strings(ids)
+
+	return dmRoomPrefix + strings.Join(ids, ",")
+}
+
+func (room *Room) isDirectMessage() bool {
+	return room.Private && isDirectMessageName(room.GetName())
+}
+
+// resolveParticipants looks up the connected clients with the given IDs,
+// leaving out client itself and duplicates. It fails if any of them is not
+// connected or has blocked client.
+func (client *Client) resolveParticipants(ids []uuid.UUID) ([]*Client, bool) {
+	participants := make([]*Client, 0, len(ids))
+	seen := map[uuid.UUID]bool{client.ID: true}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		participant := client.wsServer.clientByID(id)
+		if participant == nil || participant.hasBlocked(client.ID) {
+			return nil, false
+		}
+		participants = append(participants, participant)
+	}
+
+	return participants, true
+}
+
+// openDM puts initiator and participants in the direct message room for
+// the whole group, creating it if needed, and tells each of them they
+// joined it. The users with the offline IDs are given a seat they take when
+// they reconnect.
+func (server *WsServer) openDM(initiator *Client, participants []*Client, offline ...uuid.UUID) *Room {
+	ids := append([]uuid.UUID{initiator.ID}, offline...)
+	for _, participant := range participants {
+		ids = append(ids, participant.ID)
+	}
+	name := dmRoomName(ids)
+
+	initiator.joinRoom(name, initiator, true)
+	for _, participant := range participants {
+		participant.joinRoom(name, initiator, true)
+	}
+
+	room := server.findRoomByName(name)
+	if room != nil {
+		for _, id := range offline {
+			if !room.hasClientID(id) {
+				room.holdSeat(id)
+			}
+		}
+	}
+
+	return room
+}
+
+func (client *Client) handleCreateDMMessage(message Message) {
+	participants, ok := client.resolveParticipants(message.Participants)
+	if !ok {
+		client.logger().Warn("Direct message participant is not available", "action", message.Action)
+		return
+	}
+
+	if len(participants) == 0 || len(participants)+1 > maxDMParticipants {
+		client.logger().Warn("Invalid number of direct message participants", "action", message.Action, "participants", len(participants)+1)
+		return
+	}
+
+	client.wsServer.openDM(client, participants)
+}
+
+// handleAddDMParticipantsMessage adds people to a direct message room. A
+// one-to-one conversation stays as it is and a new group is started instead.
+// A group keeps its history and is renamed after its new set of members.
+func (client *Client) handleAddDMParticipantsMessage(message Message) {
+	if message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	if !room.isDirectMessage() || !room.hasClient(client) {
+		client.logger().Warn("Client is not allowed to add participants", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	added, ok := client.resolveParticipants(message.Participants)
+	if !ok {
+		client.logger().Warn("Direct message participant is not available", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	// Members who are offline still belong to the conversation, so they are
+	// counted and named too.
+	memberIDs := room.memberIDs()
+	newcomers := make([]*Client, 0, len(added))
+	for _, participant := range added {
+		if !room.hasClientID(participant.ID) {
+			newcomers = append(newcomers, participant)
+		}
+	}
+	if len(newcomers) == 0 {
+		return
+	}
+
+	if len(memberIDs)+len(newcomers) > maxDMParticipants {
+		client.logger().Warn("Invalid number of direct message participants", roomAttr(room), "action", message.Action, "participants", len(memberIDs)+len(newcomers))
+		return
+	}
+
+	if len(memberIDs) <= 2 {
+		participants := newcomers
+		offline := make([]uuid.UUID, 0, 1)
+		for _, id := range memberIDs {
+			if id == client.ID {
+				continue
+			}
+			if member := room.memberByID(id); member != nil {
+				participants = append(participants, member)
+			} else {
+				offline = append(offline, id)
+			}
+		}
+		client.wsServer.openDM(client, participants, offline...)
+		return
+	}
+
+	ids := memberIDs
+	for _, newcomer := range newcomers {
+		ids = append(ids, newcomer.ID)
+	}
+	name := dmRoomName(ids)
+	if !client.wsServer.renameRoom(room, name) {
+		client.logger().Warn("Direct message room already exists", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	for _, newcomer := range newcomers {
+		newcomer.joinRoom(name, client, true)
+	}
+	client.wsServer.notifyRoomUpdated(room, client)
+}
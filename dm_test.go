@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectedClients(server *WsServer, names ...string) []*Client {
+	clients := make([]*Client, 0, len(names))
+	for _, name := range names {
+		client := newClient(nil, server, name)
+		server.addClient(client)
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func participantsJSON(clients ...*Client) string {
+	ids := make([]string, 0, len(clients))
+	for _, client := range clients {
+		ids = append(ids, `"`+client.ID.String()+`"`)
+	}
+	return "[" + strings.Join(ids, ",") + "]"
+}
+
+func requireMembers(t *testing.T, room *Room, count int) {
+	require.Eventually(t, func() bool {
+		return room.memberCount() == count
+	}, time.Second, time.Millisecond)
+}
+
+func TestDMRoomName(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+
+	assert.Equal(t, dmRoomName([]uuid.UUID{a, b, c}), dmRoomName([]uuid.UUID{c, a, b}))
+	assert.Equal(t, dmRoomName([]uuid.UUID{a, b}), dmRoomName([]uuid.UUID{b, a, b}))
+	assert.NotEqual(t, dmRoomName([]uuid.UUID{a, b}), dmRoomName([]uuid.UUID{a, b, c}))
+	assert.True(t, isDirectMessageName(dmRoomName([]uuid.UUID{a, b})))
+}
+
+func TestJoinRoomPrivate_SameRoomEitherWay(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob")
+	alice, bob := clients[0], clients[1]
+
+	alice.handleNewMessage([]byte(`{"action":"join-room-private","message":"` + bob.ID.String() + `"}`))
+	bob.handleNewMessage([]byte(`{"action":"join-room-private","message":"` + alice.ID.String() + `"}`))
+
+	require.Len(t, server.roomsSnapshot(), 1)
+	room := server.roomsSnapshot()[0]
+	assert.True(t, room.isDirectMessage())
+	requireMembers(t, room, 2)
+}
+
+func TestCreateDM(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol")
+	alice, bob, carol := clients[0], clients[1], clients[2]
+
+	alice.handleNewMessage([]byte(`{"action":"create-dm","participants":` + participantsJSON(bob, carol) + `}`))
+
+	room := server.findRoomByName(dmRoomName([]uuid.UUID{alice.ID, bob.ID, carol.ID}))
+	require.NotNil(t, room)
+	assert.True(t, room.Private)
+	requireMembers(t, room, 3)
+	for _, client := range clients {
+		assert.True(t, client.isInRoom(room))
+	}
+
+	// Whoever starts it, the same people share the same conversation.
+	carol.handleNewMessage([]byte(`{"action":"create-dm","participants":` + participantsJSON(bob, alice, carol) + `}`))
+	assert.Len(t, server.roomsSnapshot(), 1)
+
+	alice.handleNewMessage([]byte(`{"action":"create-dm","participants":["` + uuid.New().String() + `"]}`))
+	alice.handleNewMessage([]byte(`{"action":"create-dm","participants":` + participantsJSON(alice) + `}`))
+	assert.Len(t, server.roomsSnapshot(), 1)
+}
+
+func TestJoinRoom_DirectMessagesAreReserved(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "mallory")
+	alice, bob, mallory := clients[0], clients[1], clients[2]
+
+	name := dmRoomName([]uuid.UUID{alice.ID, bob.ID})
+	mallory.joinRoom(name, mallory, false)
+	assert.Empty(t, server.roomsSnapshot(), "Expected public rooms not to take a direct message name")
+
+	alice.handleNewMessage([]byte(`{"action":"create-dm","participants":` + participantsJSON(bob) + `}`))
+	room := server.findRoomByName(name)
+	require.NotNil(t, room)
+	requireMembers(t, room, 2)
+
+	mallory.joinRoom(name, mallory, false)
+	assert.False(t, mallory.isInRoom(room))
+	assert.False(t, canRename(room, "lobby"))
+}
+
+func TestAddDMParticipants_Group(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := clients[0], clients[1], clients[2], clients[3]
+
+	room := server.openDM(alice, []*Client{bob, carol})
+	requireMembers(t, room, 3)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	bob.handleNewMessage([]byte(`{"action":"add-dm-participants","target":{"id":"` + room.GetId() + `"},"participants":` + participantsJSON(dave, carol) + `}`))
+
+	requireMembers(t, room, 4)
+	assert.Equal(t, dmRoomName([]uuid.UUID{alice.ID, bob.ID, carol.ID, dave.ID}), room.GetName())
+	assert.Len(t, server.roomsSnapshot(), 1, "Expected the group to keep its room")
+
+	// The room's member list may reach dave first.
+	var joined MessageView
+	for joined.Action != RoomJoinedAction {
+		require.NoError(t, json.Unmarshal(<-dave.send, &joined))
+	}
+	assert.Equal(t, room.ID, joined.Target.ID)
+}
+
+func TestAddDMParticipants_OneToOne(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol", "mallory")
+	alice, bob, carol, mallory := clients[0], clients[1], clients[2], clients[3]
+
+	pair := server.openDM(alice, []*Client{bob})
+	requireMembers(t, pair, 2)
+
+	mallory.handleNewMessage([]byte(`{"action":"add-dm-participants","target":{"id":"` + pair.GetId() + `"},"participants":` + participantsJSON(mallory) + `}`))
+	assert.Len(t, server.roomsSnapshot(), 1, "Expected only members to add participants")
+
+	alice.handleNewMessage([]byte(`{"action":"add-dm-participants","target":{"id":"` + pair.GetId() + `"},"participants":` + participantsJSON(carol) + `}`))
+
+	assert.Equal(t, dmRoomName([]uuid.UUID{alice.ID, bob.ID}), pair.GetName(), "Expected the one-to-one conversation to stay as it is")
+	group := server.findRoomByName(dmRoomName([]uuid.UUID{alice.ID, bob.ID, carol.ID}))
+	require.NotNil(t, group)
+	requireMembers(t, group, 3)
+	assert.False(t, carol.isInRoom(pair))
+}
+
+func TestSendMessage_OnlyMembers(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "mallory")
+	alice, bob, mallory := clients[0], clients[1], clients[2]
+	room := server.openDM(alice, []*Client{bob})
+	requireMembers(t, room, 2)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	// DM room IDs can be worked out from the participants' IDs.
+	mallory.handleNewMessage([]byte(`{"action":"send-message","message":"hi","target":{"id":"` + room.GetId() + `"}}`))
+
+	var rejected ErrorMessage
+	require.NoError(t, json.Unmarshal(<-mallory.send, &rejected))
+	assert.Equal(t, ErrorAction, rejected.Action)
+	assert.Equal(t, errNotRoomMember.Error(), rejected.Error)
+	assert.Empty(t, room.history())
+	assert.Empty(t, bob.send)
+}
+
+func TestDisconnect_KeepsDMMembership(t *testing.T) {
+	server := NewWebsocketServer()
+	go server.Run()
+	clients := connectedClients(server, "alice", "bob")
+	alice, bob := clients[0], clients[1]
+	room := server.openDM(alice, []*Client{bob})
+	requireMembers(t, room, 2)
+
+	bob.disconnect()
+
+	require.Eventually(t, func() bool {
+		return !server.isOnline(bob.ID)
+	}, time.Second, time.Millisecond, "Expected clients in private rooms to go offline")
+	assert.Equal(t, 1, room.memberCount())
+	assert.True(t, room.hasClientID(bob.ID))
+	assert.Zero(t, room.idleFor(time.Now().Add(time.Hour)))
+
+	returning := newClient(nil, server, "bob")
+	returning.ID = bob.ID
+	server.restoreSeats(returning)
+
+	assert.True(t, room.hasClient(returning))
+	assert.True(t, returning.isInRoom(room))
+	assert.False(t, room.hasClient(bob))
+	assert.Equal(t, 2, room.memberCount())
+}
+
+func TestSendMessage_MentionOutsiderOfDM(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "mallory")
+	alice, bob, mallory := clients[0], clients[1], clients[2]
+	room := server.openDM(alice, []*Client{bob})
+	requireMembers(t, room, 2)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	alice.handleNewMessage([]byte(`{"action":"send-message","message":"secret @` + mallory.ID.String() + `","target":{"id":"` + room.GetId() + `"}}`))
+
+	require.Len(t, room.history(), 1)
+	assert.Empty(t, room.history()[0].Mentions)
+	assert.Empty(t, mallory.send, "Expected non-members not to be sent the message")
+	assert.Empty(t, server.mentions.list(mallory.ID))
+}
+
+func TestAddDMParticipants_OfflineMembers(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := clients[0], clients[1], clients[2], clients[3]
+
+	group := server.openDM(alice, []*Client{bob, carol})
+	requireMembers(t, group, 3)
+	group.keepSeat(carol)
+
+	alice.handleNewMessage([]byte(`{"action":"add-dm-participants","target":{"id":"` + group.GetId() + `"},"participants":` + participantsJSON(dave) + `}`))
+
+	requireMembers(t, group, 3)
+	assert.Equal(t, dmRoomName([]uuid.UUID{alice.ID, bob.ID, carol.ID, dave.ID}), group.GetName(), "Expected offline members to stay in the group")
+	assert.True(t, group.hasClientID(carol.ID))
+	assert.Len(t, server.roomsSnapshot(), 1)
+
+	pair := server.openDM(alice, []*Client{bob})
+	requireMembers(t, pair, 2)
+	pair.keepSeat(bob)
+
+	alice.handleNewMessage([]byte(`{"action":"add-dm-participants","target":{"id":"` + pair.GetId() + `"},"participants":` + participantsJSON(carol) + `}`))
+
+	created := server.findRoomByName(dmRoomName([]uuid.UUID{alice.ID, bob.ID, carol.ID}))
+	require.NotNil(t, created, "Expected the new group to include the offline member")
+	requireMembers(t, created, 2)
+	assert.True(t, created.hasClientID(bob.ID))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What a WordFilter does with a message containing one of its words.
+const (
+	WordActionMask   = "mask"
+	WordActionReject = "reject"
+)
+
+var (
+	errBlockedWord         = errors.New("message contains a word that is not allowed in this room")
+	errMessageTooLong      = errors.New("message is too long for this room")
+	errLinkNotAllowed      = errors.New("message contains a link that is not allowed in this room")
+	errRepeatedCharacters  = errors.New("message repeats the same character too often")
+	errInvalidWordAction   = errors.New("word action must be mask or reject")
+	errNegativeFilterLimit = errors.New("filter limits must not be negative")
+)
+
+// linkPattern finds the links in a message, with or without a scheme.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// MessageFilter checks the text of a message before it is stored and
+// broadcast. It returns the text to send on, which it may have changed, or an
+// error telling the sender why the message was rejected.
+type MessageFilter interface {
+	Filter(text string) (string, error)
+}
+
+// FilterPipeline runs its filters in order, each on the output of the last.
+type FilterPipeline []MessageFilter
+
+func (pipeline FilterPipeline) Filter(text string) (string, error) {
+	for _, filter := range pipeline {
+		var err error
+		if text, err = filter.Filter(text); err != nil {
+			return "", err
+		}
+	}
+
+	return text, nil
+}
+
+// WordFilter masks or rejects whole words from a list, ignoring case. A word
+// only counts when it is not part of a longer word, in any script.
+type WordFilter struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+func NewWordFilter(words []string, action string) *WordFilter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, regexp.QuoteMeta(word))
+	}
+
+	// \b only knows ASCII letters, so the pattern is matched at the start of
+	// every word instead and the character after it is checked here.
+	return &WordFilter{
+		pattern: regexp.MustCompile(`(?i)^(` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`),
+		action:  action,
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// matches returns the byte ranges of the listed words in text.
+func (filter *WordFilter) matches(text string) [][2]int {
+	var found [][2]int
+	previous := ' '
+	for i := 0; i < len(text); {
+		if !isWordRune(previous) {
+			if loc := filter.pattern.FindStringSubmatchIndex(text[i:]); loc != nil {
+				found = append(found, [2]int{i, i + loc[3]})
+				i += loc[3]
+				previous, _ = utf8.DecodeLastRuneInString(text[:i])
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(text[i:])
+		previous = r
+		i += size
+	}
+
+	return found
+}
+
+func (filter *WordFilter) Filter(text string) (string, error) {
+	found := filter.matches(text)
+	if len(found) == 0 {
+		return text, nil
+	}
+	if filter.action == WordActionReject {
+		return "", errBlockedWord
+	}
+
+	var masked strings.Builder
+	last := 0
+	for _, match := range found {
+		masked.WriteString(text[last:match[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[match[0]:match[1]])))
+		last = match[1]
+	}
+	masked.WriteString(text[last:])
+
+	return masked.String(), nil
+}
+
+// MaxLengthFilter rejects messages longer than Max characters.
+type MaxLengthFilter struct {
+	Max int
+}
+
+func (filter MaxLengthFilter) Filter(text string) (string, error) {
+	if utf8.RuneCountInString(text) > filter.Max {
+		return "", errMessageTooLong
+	}
+
+	return text, nil
+}
+
+// LinkFilter rejects messages with links to the Denied domains or, if
+// Allowed is not empty, to any domain but the Allowed ones. A domain also
+// matches its subdomains.
+type LinkFilter struct {
+	Allowed []string
+	Denied  []string
+}
+
+func (filter LinkFilter) Filter(text string) (string, error) {
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+
+		parsed, err := url.Parse(link)
+		if err != nil {
+			return "", errLinkNotAllowed
+		}
+
+		host := strings.ToLower(parsed.Hostname())
+		if matchesDomain(host, filter.Denied) {
+			return "", errLinkNotAllowed
+		}
+		if len(filter.Allowed) > 0 && !matchesDomain(host, filter.Allowed) {
+			return "", errLinkNotAllowed
+		}
+	}
+
+	return text, nil
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RepeatFilter rejects messages that repeat a character more than Max times
+// in a row.
+type RepeatFilter struct {
+	Max int
+}
+
+func (filter RepeatFilter) Filter(text string) (string, error) {
+	var last rune
+	run := 0
+	for _, r := range text {
+		if r == last {
+			run++
+		} else {
+			last, run = r, 1
+		}
+
+		if run > filter.Max {
+			return "", errRepeatedCharacters
+		}
+	}
+
+	return text, nil
+}
+
+// FilterPolicy configures the filters a room runs its messages through.
+// Filters whose settings are left empty are not run.
+type FilterPolicy struct {
+	Words            []string `json:"words,omitempty"`
+	WordAction       string   `json:"wordAction,omitempty"`
+	MaxLength        int      `json:"maxLength,omitempty"`
+	AllowedLinks     []string `json:"allowedLinks,omitempty"`
+	DeniedLinks      []string `json:"deniedLinks,omitempty"`
+	MaxRepeatedChars int      `json:"maxRepeatedChars,omitempty"`
+}
+
+func (policy FilterPolicy) validate() error {
+	if policy.WordAction != "" && policy.WordAction != WordActionMask && policy.WordAction != WordActionReject {
+		return errInvalidWordAction
+	}
+	if policy.MaxLength < 0 || policy.MaxRepeatedChars < 0 {
+		return errNegativeFilterLimit
+	}
+
+	return nil
+}
+
+// pipeline builds the filters for the policy. Messages are checked for
+// length, spam and links before words are masked.
+func (policy FilterPolicy) pipeline() FilterPipeline {
+	pipeline := FilterPipeline{}
+	if policy.MaxLength > 0 {
+		pipeline = append(pipeline, MaxLengthFilter{Max: policy.MaxLength})
+	}
+	if policy.MaxRepeatedChars > 0 {
+		pipeline = append(pipeline, RepeatFilter{Max: policy.MaxRepeatedChars})
+	}
+	if len(policy.AllowedLinks) > 0 || len(policy.DeniedLinks) > 0 {
+		pipeline = append(pipeline, LinkFilter{Allowed: policy.AllowedLinks, Denied: policy.DeniedLinks})
+	}
+
+	words := make([]string, 0, len(policy.Words))
+	for _, word := range policy.Words {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, word)
+		}
+	}
+	if len(words) > 0 {
+		action := policy.WordAction
+		if action == "" {
+			action = WordActionMask
+		}
+		pipeline = append(pipeline, NewWordFilter(words, action))
+	}
+
+	return pipeline
+}
+
+func (room *Room) filterPolicy() FilterPolicy {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	return room.Filters
+}
+
+// setFilterPolicy validates policy and replaces the room's filters with it.
+func (room *Room) setFilterPolicy(policy FilterPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	pipeline := policy.pipeline()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.Filters = policy
+	room.filters = pipeline
+	return nil
+}
+
+// filter runs text through the room's filters.
+func (room *Room) filter(text string) (string, error) {
+	room.mu.Lock()
+	pipeline := room.filters
+	room.mu.Unlock()
+
+	return pipeline.Filter(text)
+}
+
+// sendError tells the client why its request for action was refused.
+func (client *Client) sendError(action string, room *Room, err error) {
+	errorMsg := &ErrorMessage{
+		Action:        ErrorAction,
+		RequestAction: action,
+		Error:         err.Error(),
+	}
+	if room != nil {
+		target := room.summary()
+		errorMsg.Target = &target
+	}
+
+	client.enqueue(errorMsg.encode())
+}
+
+func (client *Client) handleSetFiltersMessage(message Message) {
+	if message.Filters == nil || message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	if room.Owner == nil || room.Owner.ID != client.ID {
+		client.logger().Warn("Client is not allowed to change filters", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	if err := room.setFilterPolicy(*message.Filters); err != nil {
+		client.sendError(message.Action, room, err)
+		return
+	}
+
+	// Only the owner is told, so the word list is not shown to the members.
+	updatedMsg := &FiltersUpdatedMessage{
+		Action:  FiltersUpdatedAction,
+		RoomID:  room.ID,
+		Filters: room.filterPolicy(),
+	}
+	client.enqueue(updatedMsg.encode())
+	client.logger().Info("Updated room filters", roomAttr(room))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWordFilter(t *testing.T) {
+	mask := NewWordFilter([]string{"darn", "heck"}, WordActionMask)
+
+	text, err := mask.Filter("Darn it, what the heck? Darned hecks.")
+	require.NoError(t, err)
+	assert.Equal(t, "**** it, what the ****? Darned hecks.", text, "Expected only whole words to be masked")
+
+	reject := NewWordFilter([]string{"darn"}, WordActionReject)
+	_, err = reject.Filter("oh DARN")
+	assert.ErrorIs(t, err, errBlockedWord)
+	text, err = reject.Filter("darned")
+	assert.NoError(t, err)
+	assert.Equal(t, "darned", text)
+}
+
+func TestWordFilter_NonASCII(t *testing.T) {
+	mask := NewWordFilter([]string{"дурак", "c++", "darn"}, WordActionMask)
+
+	text, err := mask.Filter("Ты ДУРАК, дураки! c++ and c++x, darn_it darn darn")
+	require.NoError(t, err)
+	assert.Equal(t, "Ты *****, дураки! *** and c++x, darn_it **** ****", text)
+
+	_, err = NewWordFilter([]string{"дурак"}, WordActionReject).Filter("сам дурак")
+	assert.ErrorIs(t, err, errBlockedWord)
+	_, err = NewWordFilter([]string{"café"}, WordActionReject).Filter("cafés")
+	assert.NoError(t, err)
+}
+
+func TestMaxLengthFilter(t *testing.T) {
+	filter := MaxLengthFilter{Max: 3}
+
+	_, err := filter.Filter("ééé")
+	assert.NoError(t, err)
+	_, err = filter.Filter("éééé")
+	assert.ErrorIs(t, err, errMessageTooLong)
+}
+
+func TestLinkFilter(t *testing.T) {
+	denied := LinkFilter{Denied: []string{"spam.example"}}
+	_, err := denied.Filter("see https://cdn.SPAM.example/x")
+	assert.ErrorIs(t, err, errLinkNotAllowed)
+	_, err = denied.Filter("see https://example.org and notspam.example")
+	assert.NoError(t, err)
+
+	allowed := LinkFilter{Allowed: []string{"example.org"}}
+	_, err = allowed.Filter("docs at https://docs.example.org/guide")
+	assert.NoError(t, err)
+	_, err = allowed.Filter("or www.elsewhere.com")
+	assert.ErrorIs(t, err, errLinkNotAllowed)
+	_, err = allowed.Filter("no links here")
+	assert.NoError(t, err)
+}
+
+func TestRepeatFilter(t *testing.T) {
+	filter := RepeatFilter{Max: 4}
+
+	_, err := filter.Filter("sooooo good")
+	assert.ErrorIs(t, err, errRepeatedCharacters)
+	_, err = filter.Filter("soooo good " + strings.Repeat("ab", 20))
+	assert.NoError(t, err)
+}
+
+func TestFilterPolicy(t *testing.T) {
+	assert.ErrorIs(t, FilterPolicy{WordAction: "shout"}.validate(), errInvalidWordAction)
+	assert.ErrorIs(t, FilterPolicy{MaxLength: -1}.validate(), errNegativeFilterLimit)
+	assert.Empty(t, FilterPolicy{Words: []string{" "}}.pipeline())
+
+	pipeline := FilterPolicy{Words: []string{"darn"}, MaxLength: 10}.pipeline()
+	require.Len(t, pipeline, 2)
+
+	// The length is checked before masking, which keeps it the same anyway.
+	text, err := pipeline.Filter("darn it")
+	require.NoError(t, err)
+	assert.Equal(t, "**** it", text)
+	_, err = pipeline.Filter("darn it all")
+	assert.ErrorIs(t, err, errMessageTooLong)
+}
+
+func TestSetFilters(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "owner", "member")
+	owner, member := clients[0], clients[1]
+	room := server.createRoom("general", false, owner)
+
+	member.handleNewMessage([]byte(`{"action":"set-filters","target":{"id":"` + room.GetId() + `"},"filters":{"maxLength":5}}`))
+	assert.Equal(t, FilterPolicy{}, room.filterPolicy(), "Expected only the owner to set filters")
+
+	owner.handleNewMessage([]byte(`{"action":"set-filters","target":{"id":"` + room.GetId() + `"},"filters":{"wordAction":"shout"}}`))
+	var rejected ErrorMessage
+	require.NoError(t, json.Unmarshal(<-owner.send, &rejected))
+	assert.Equal(t, ErrorAction, rejected.Action)
+	assert.Equal(t, SetFiltersAction, rejected.RequestAction)
+
+	owner.handleNewMessage([]byte(`{"action":"set-filters","target":{"id":"` + room.GetId() + `"},"filters":{"words":["darn"],"maxLength":20}}`))
+	var updated FiltersUpdatedMessage
+	require.NoError(t, json.Unmarshal(<-owner.send, &updated))
+	assert.Equal(t, FiltersUpdatedAction, updated.Action)
+	assert.Equal(t, room.ID, updated.RoomID)
+	assert.Equal(t, 20, updated.Filters.MaxLength)
+	assert.Empty(t, member.send)
+}
+
+func TestSendMessage_Filtered(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob")
+	alice, bob := clients[0], clients[1]
+	room := server.createRoom("general", false, nil)
+	require.NoError(t, room.setFilterPolicy(FilterPolicy{Words: []string{"darn"}, MaxLength: 20}))
+	for _, client := range clients {
+		require.True(t, room.join(client))
+	}
+	requireMembers(t, room, 2)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	alice.handleNewMessage([]byte(`{"action":"send-message","message":"this message is far too long","target":{"id":"` + room.GetId() + `"}}`))
+
+	var rejected ErrorMessage
+	require.NoError(t, json.Unmarshal(<-alice.send, &rejected))
+	assert.Equal(t, ErrorAction, rejected.Action)
+	assert.Equal(t, SendMessageAction, rejected.RequestAction)
+	assert.Equal(t, errMessageTooLong.Error(), rejected.Error)
+	require.NotNil(t, rejected.Target)
+	assert.Equal(t, room.ID, rejected.Target.ID)
+	assert.Empty(t, room.history(), "Expected rejected messages not to be stored")
+
+	alice.handleNewMessage([]byte(`{"action":"send-message","message":"darn it","target":{"id":"` + room.GetId() + `"}}`))
+
+	var received MessageView
+	require.NoError(t, json.Unmarshal(<-bob.send, &received))
+	assert.Equal(t, "**** it", received.Message)
+	require.Len(t, room.history(), 1)
+	assert.Equal(t, "**** it", room.history()[0].Message)
+}
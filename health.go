@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// readyTimeout is how long /readyz waits for the Run loop to answer a ping.
+const readyTimeout = time.Second
+
+var errShuttingDown = errors.New("server is shutting down")
+
+type RoomStats struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+type ServerStats struct {
+	Clients    int         `json:"clients"`
+	Rooms      int         `json:"rooms"`
+	RoomStats  []RoomStats `json:"roomMembers"`
+	Goroutines int         `json:"goroutines"`
+}
+
+// pingRunLoop checks that the Run loop is still taking work off its channels.
+func (server *WsServer) pingRunLoop(timeout time.Duration) error {
+	reply := make(chan struct{})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case server.ping <- reply:
+	case <-timer.C:
+		return errors.New("run loop is not responding")
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-timer.C:
+		return errors.New("run loop is not responding")
+	}
+}
+
+// ready reports why the server cannot take traffic, or nil if it can.
+func (server *WsServer) ready() error {
+	if server.shuttingDown.Load() {
+		return errShuttingDown
+	}
+
+	if err := server.pingRunLoop(readyTimeout); err != nil {
+		return err
+	}
+
+	if err := server.broker.Check(); err != nil {
+		return fmt.Errorf("broker: %w", err)
+	}
+
+	if server.media != nil {
+		if err := server.media.Check(); err != nil {
+			return fmt.Errorf("media store: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown makes the server report itself as not ready, so load balancers
+// stop sending it new connections while it drains.
+func (server *WsServer) Shutdown() {
+	server.shuttingDown.Store(true)
+}
+
+func (server *WsServer) stats() ServerStats {
+	rooms := server.roomsSnapshot()
+	stats := ServerStats{
+		Clients:    len(server.clientsSnapshot()),
+		Rooms:      len(rooms),
+		RoomStats:  make([]RoomStats, 0, len(rooms)),
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	// Private room names, such as those of direct messages, say who talks
+	// to whom, and the endpoint is not authenticated.
+	for _, room := range rooms {
+		if room.Private {
+			continue
+		}
+		stats.RoomStats = append(stats.RoomStats, RoomStats{
+			ID:      room.GetId(),
+			Name:    room.GetName(),
+			Members: room.memberCount(),
+		})
+	}
+
+	sort.Slice(stats.RoomStats, func(i, j int) bool {
+		return stats.RoomStats[i].Name < stats.RoomStats[j].Name
+	})
+
+	return stats
+}
+
+// ServeHealthz handles GET /healthz. It only tells that the process is up.
+func ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// ServeReadyz handles GET /readyz. It fails while the Run loop is stuck, the
+// broker or the media store cannot be reached or the server is shutting down.
+func (server *WsServer) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := server.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// ServeStats handles GET /debug/stats.
+func (server *WsServer) ServeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server.stats())
+}
+
+// Check reports whether the media directory can still be reached.
+func (store *MediaStore) Check() error {
+	info, err := os.Stat(store.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", store.dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeHealthz(t *testing.T) {
+	rr := httptest.NewRecorder()
+	ServeHealthz(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestServeReadyz(t *testing.T) {
+	server := NewWebsocketServer()
+	store, err := NewMediaStore(filepath.Join(t.TempDir(), "media"), 1024)
+	require.NoError(t, err)
+	server.media = store
+
+	readyz := func() int {
+		rr := httptest.NewRecorder()
+		server.ServeReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rr.Code
+	}
+
+	// The Run loop has not been started yet.
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+
+	go server.Run()
+	assert.Equal(t, http.StatusOK, readyz())
+
+	require.NoError(t, os.RemoveAll(store.dir))
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+
+	require.NoError(t, os.MkdirAll(store.dir, 0755))
+	server.Shutdown()
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+}
+
+// unreachableBroker is a broker that has lost its connection.
+type unreachableBroker struct {
+	*LocalBroker
+}
+
+func (broker unreachableBroker) Check() error {
+	return errBrokerDisconnected
+}
+
+func TestServeReadyz_BrokerDown(t *testing.T) {
+	server, err := NewWebsocketServerWithBroker(unreachableBroker{NewLocalBroker()})
+	require.NoError(t, err)
+	go server.Run()
+
+	rr := httptest.NewRecorder()
+	server.ServeReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), errBrokerDisconnected.Error())
+}
+
+func TestServeStats(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	server.addClient(client)
+	room := NewRoom("stats", false, nil)
+	room.registerClientInRoom(client)
+	server.addRoom(room)
+	server.addRoom(NewRoom(dmRoomName([]uuid.UUID{client.ID, uuid.New()}), true, nil))
+
+	rr := httptest.NewRecorder()
+	server.ServeStats(rr, httptest.NewRequest(http.MethodGet, "/debug/stats", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats ServerStats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Clients)
+	assert.Equal(t, 2, stats.Rooms)
+	assert.Equal(t, []RoomStats{{ID: room.GetId(), Name: "stats", Members: 1}}, stats.RoomStats, "Expected private rooms to be left out")
+	assert.Positive(t, stats.Goroutines)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+type LogConfig struct {
+	Format     string
+	Level      string
+	File       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+// newLogger builds the server logger from config. The returned closer has to
+// be closed on shutdown when logging to a file.
+func newLogger(config LogConfig) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level %q", config.Level)
+	}
+
+	var output io.WriteCloser = nopCloser{os.Stdout}
+	if config.File != "" {
+		file, err := newRotatingFile(config.File, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		output = file
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	case "text":
+		handler = slog.NewTextHandler(output, options)
+	default:
+		output.Close()
+		return nil, nil, fmt.Errorf("invalid log format %q", config.Format)
+	}
+
+	return slog.New(handler), output, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is a log file that is renamed to path.1 once it grows past
+// maxSize, shifting older backups up and keeping at most maxBackups of them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rotating := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *rotatingFile) Write(p []byte) (int, error) {
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+
+	if rotating.maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+func (rotating *rotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+
+	if rotating.maxBackups > 0 {
+		for i := rotating.maxBackups - 1; i > 0; i-- {
+			os.Rename(rotating.backupPath(i), rotating.backupPath(i+1))
+		}
+		if err := os.Rename(rotating.path, rotating.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rotating.path); err != nil {
+		return err
+	}
+
+	return rotating.open()
+}
+
+func (rotating *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", rotating.path, n)
+}
+
+func (rotating *rotatingFile) Close() error {
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+
+	return rotating.file.Close()
+}
+
+// logger returns the default logger with the client's attributes attached.
+func (client *Client) logger() *slog.Logger {
+	return slog.With("clientId", client.ID, "clientName", client.Name)
+}
+
+func roomAttr(room *Room) slog.Attr {
+	return slog.String("roomId", room.GetId())
+}
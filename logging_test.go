@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger_InvalidConfig(t *testing.T) {
+	_, _, err := newLogger(LogConfig{Format: "text", Level: "loud"})
+	assert.Error(t, err)
+
+	_, _, err = newLogger(LogConfig{Format: "xml", Level: "info"})
+	assert.Error(t, err)
+}
+
+func TestNewLogger_FileAndLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+
+	logger, closer, err := newLogger(LogConfig{Format: "json", Level: "warn", File: path})
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown", "roomId", "abc")
+	require.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	require.Len(t, lines, 1)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &entry))
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, "abc", entry["roomId"])
+}
+
+func TestRotatingFile_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+
+	file, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\n", string(current))
+
+	backup, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(backup))
+
+	backup, err = os.ReadFile(path + ".2")
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(backup))
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClientLogger_Attributes(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(previous)
+
+	client := newClient(nil, nil, "test")
+	room := NewRoom("room", false, nil)
+	client.logger().Info("hello", roomAttr(room), "action", SendMessageAction)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, client.ID.String(), entry["clientId"])
+	assert.Equal(t, "test", entry["clientName"])
+	assert.Equal(t, room.ID.String(), entry["roomId"])
+	assert.Equal(t, SendMessageAction, entry["action"])
+}
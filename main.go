@@ -1,49 +1,166 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var addr = flag.String("addr", ":8085", "http server address")
+var mediaDir = flag.String("media-dir", "media", "directory where uploaded media is stored")
+var mediaMaxSize = flag.Int64("media-max-size", 1024*1024*10, "maximum media upload size in bytes")
+var retentionMaxAge = flag.Duration("retention-max-age", 0, "default maximum age of room messages, 0 keeps them forever")
+var retentionMaxMessages = flag.Int("retention-max-messages", 0, "default number of messages kept per room, 0 keeps all of them")
+var janitorInterval = flag.Duration("janitor-interval", time.Minute, "how often expired messages are pruned and idle rooms deleted")
+var ephemeralRoomTTL = flag.Duration("ephemeral-room-ttl", defaultEphemeralRoomTTL, "how long a room created by a client may stay empty before it is deleted, 0 keeps them")
+var deletedHistory = flag.String("deleted-room-history", DeletedHistoryPurge, "what happens to the media of a deleted room: purge or keep-media")
+var idleTimeout = flag.Duration("idle-timeout", defaultIdleTimeout, "inactivity after which online clients are shown as away")
+var shutdownDelay = flag.Duration("shutdown-delay", 5*time.Second, "how long /readyz fails before the server stops accepting connections on shutdown")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight HTTP requests on shutdown")
+var adminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token for the /admin/api endpoints, which are disabled when empty (defaults to $ADMIN_TOKEN)")
+var maintenanceMessage = flag.String("maintenance-message", "The server will restart for maintenance shortly.", "announcement sent to all clients on SIGUSR1")
+var maintenanceNoticeTTL = flag.Duration("maintenance-notice-ttl", 15*time.Minute, "how long the SIGUSR1 maintenance notice stays active")
+var redisAddr = flag.String("redis-addr", "", "address of a Redis compatible server used to share rooms and presence between nodes, empty runs a single node")
+var overflowPolicy = flag.String("overflow-policy", OverflowDisconnect, "what happens when a client's send buffer is full: drop-oldest, coalesce-presence or disconnect")
+var logFormat = flag.String("log-format", "text", "log format, text or json")
+var logLevel = flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+var logFile = flag.String("log-file", "", "file to write logs to instead of stdout")
+var logMaxSize = flag.Int64("log-max-size", 1024*1024*100, "size in bytes at which the log file is rotated, 0 disables rotation")
+var logMaxBackups = flag.Int("log-max-backups", 5, "number of rotated log files to keep")
 
 func main() {
 	flag.Parse()
 
-	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logger, logOutput, err := newLogger(LogConfig{
+		Format:     *logFormat,
+		Level:      *logLevel,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxBackups: *logMaxBackups,
+	})
 	if err != nil {
-		log.Fatal("Failed to open log file:", err)
+		log.Fatal("Failed to set up logging:", err)
 	}
-	defer logFile.Close()
+	defer logOutput.Close()
+
+	slog.SetDefault(logger)
 
-	log.SetOutput(logFile)
+	mediaStore, err := NewMediaStore(*mediaDir, *mediaMaxSize)
+	if err != nil {
+		slog.Error("Failed to open media store", "dir", *mediaDir, "error", err)
+		os.Exit(1)
+	}
 
-	wsServer := NewWebsocketServer()
+	var broker Broker = NewLocalBroker()
+	if *redisAddr != "" {
+		broker, err = NewRedisBroker(*redisAddr)
+		if err != nil {
+			slog.Error("Failed to connect to the broker", "addr", *redisAddr, "error", err)
+			os.Exit(1)
+		}
+	}
+	defer broker.Close()
+
+	wsServer, err := NewWebsocketServerWithBroker(broker)
+	if err != nil {
+		slog.Error("Failed to subscribe to the broker", "error", err)
+		os.Exit(1)
+	}
+	if !isOverflowPolicy(*overflowPolicy) {
+		slog.Error("Invalid overflow policy", "policy", *overflowPolicy)
+		os.Exit(1)
+	}
+	wsServer.overflowPolicy = *overflowPolicy
+	if !isDeletedHistoryPolicy(*deletedHistory) {
+		slog.Error("Invalid deleted room history policy", "policy", *deletedHistory)
+		os.Exit(1)
+	}
+	wsServer.deletedHistory = *deletedHistory
+	wsServer.ephemeralRoomTTL = *ephemeralRoomTTL
+	if *idleTimeout <= 0 {
+		slog.Error("Invalid idle timeout, it must be positive", "idleTimeout", *idleTimeout)
+		os.Exit(1)
+	}
+	wsServer.media = mediaStore
+	wsServer.defaultRetention = RetentionPolicy{
+		MaxAgeSeconds: int64(retentionMaxAge.Seconds()),
+		MaxMessages:   *retentionMaxMessages,
+	}
 	go func() {
-		log.Println("Starting WebSocket server...")
+		slog.Info("Starting WebSocket server")
 		wsServer.Run()
 	}()
+	go wsServer.RunJanitor(*janitorInterval)
+	go wsServer.RunPresenceMonitor(*idleTimeout)
+	go announceOnSignal(wsServer)
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Received WebSocket connection request")
+		slog.Debug("Received WebSocket connection request", "remoteAddr", r.RemoteAddr)
+		if wsServer.shuttingDown.Load() {
+			http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		ServeWs(wsServer, w, r)
 	})
-
-	log.Println("Starting HTTP server on", *addr)
-	err = http.ListenAndServe(*addr, nil)
-	if err != nil {
-		log.Fatal("HTTP server failed to start:", err)
+	http.HandleFunc("/media", wsServer.ServeMediaUpload)
+	http.HandleFunc("/media/", mediaStore.ServeDownload)
+	http.HandleFunc("/search", wsServer.ServeSearch)
+	http.Handle("/metrics", metrics)
+	http.HandleFunc("/healthz", ServeHealthz)
+	http.HandleFunc("/readyz", wsServer.ServeReadyz)
+	http.HandleFunc("/debug/stats", wsServer.ServeStats)
+	if *adminToken != "" {
+		http.Handle(adminAPIPrefix, NewAdminAPI(wsServer, *adminToken))
+	} else {
+		slog.Warn("No admin token set, the admin API is disabled")
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	httpServer := &http.Server{Addr: *addr}
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
-		log.Println("Shutting down server...")
-		os.Exit(0)
+
+		slog.Info("Shutting down server", "drainDelay", *shutdownDelay)
+		wsServer.Shutdown()
+		time.Sleep(*shutdownDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Error("HTTP server did not shut down cleanly", "error", err)
+		}
 	}()
+
+	slog.Info("Starting HTTP server", "addr", *addr)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed to start", "error", err)
+		os.Exit(1)
+	}
+
+	<-stopped
+}
+
+// announceOnSignal sends the maintenance notice every time the process gets
+// SIGUSR1.
+func announceOnSignal(wsServer *WsServer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		if _, err := wsServer.announce(*maintenanceMessage, SeverityWarning, *maintenanceNoticeTTL); err != nil {
+			slog.Error("Failed to send maintenance notice", "error", err)
+			continue
+		}
+		slog.Info("Sent maintenance notice")
+	}
 }
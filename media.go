@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sniffLen           = 512
+	multipartOverhead  = 1024 * 64
+	mediaFormFieldName = "file"
+)
+
+var (
+	errMediaTooLarge = errors.New("media exceeds the maximum upload size")
+	errMediaNotFound = errors.New("media not found")
+	errMediaEmpty    = errors.New("media is empty")
+
+	mediaIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// MediaInfo describes a blob stored in the MediaStore. The ID is the hex
+// encoded SHA-256 of the content, so identical uploads share one blob.
+type MediaInfo struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	FileName    string    `json:"fileName,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	ThumbnailID string    `json:"thumbnailId,omitempty"`
+}
+
+// MediaStore keeps uploaded blobs on local disk next to a small JSON file
+// holding their metadata.
+type MediaStore struct {
+	dir     string
+	maxSize int64
+	mu      sync.RWMutex
+
+	// thumbnails limits how many uploads are decoded for a thumbnail at once.
+	thumbnails chan struct{}
+}
+
+func NewMediaStore(dir string, maxSize int64) (*MediaStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &MediaStore{
+		dir:        dir,
+		maxSize:    maxSize,
+		thumbnails: make(chan struct{}, maxConcurrentThumbnails),
+	}, nil
+}
+
+func isValidMediaID(id string) bool {
+	return mediaIDPattern.MatchString(id)
+}
+
+func (store *MediaStore) blobPath(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+func (store *MediaStore) metaPath(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+// Save streams r to disk while hashing it. The content type is sniffed from
+// the first bytes rather than trusted from the uploader.
+func (store *MediaStore) Save(r io.Reader, fileName string) (*MediaInfo, error) {
+	tmp, err := os.CreateTemp(store.dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	head := make([]byte, 0, sniffLen)
+	limited := io.LimitReader(r, store.maxSize+1)
+
+	buf := make([]byte, 32*1024)
+	var size int64
+	for {
+		n, readErr := limited.Read(buf)
+		if n > 0 {
+			size += int64(n)
+			if size > store.maxSize {
+				return nil, errMediaTooLarge
+			}
+			if len(head) < sniffLen {
+				head = append(head, buf[:min(n, sniffLen-len(head))]...)
+			}
+			hash.Write(buf[:n])
+			if _, err := tmp.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	if size == 0 {
+		return nil, errMediaEmpty
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	info := &MediaInfo{
+		ID:          hex.EncodeToString(hash.Sum(nil)),
+		ContentType: http.DetectContentType(head),
+		Size:        size,
+		FileName:    filepath.Base(fileName),
+		CreatedAt:   time.Now(),
+	}
+	if info.FileName == "." || info.FileName == string(filepath.Separator) {
+		info.FileName = ""
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if existing, err := store.readInfo(info.ID); err == nil {
+		return existing, nil
+	}
+
+	if err := os.Rename(tmp.Name(), store.blobPath(info.ID)); err != nil {
+		return nil, err
+	}
+	if err := store.writeInfo(info); err != nil {
+		os.Remove(store.blobPath(info.ID))
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (store *MediaStore) readInfo(id string) (*MediaInfo, error) {
+	data, err := os.ReadFile(store.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info MediaInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (store *MediaStore) writeInfo(info *MediaInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(store.metaPath(info.ID), data, 0644)
+}
+
+func (store *MediaStore) Stat(id string) (*MediaInfo, error) {
+	if !isValidMediaID(id) {
+		return nil, errMediaNotFound
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.readInfo(id)
+}
+
+// Update replaces the stored metadata of an existing blob.
+func (store *MediaStore) Update(info *MediaInfo) error {
+	if !isValidMediaID(info.ID) {
+		return errMediaNotFound
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, err := store.readInfo(info.ID); err != nil {
+		return err
+	}
+
+	return store.writeInfo(info)
+}
+
+// Open returns the blob for id. The caller must close the returned file.
+func (store *MediaStore) Open(id string) (*os.File, *MediaInfo, error) {
+	if !isValidMediaID(id) {
+		return nil, nil, errMediaNotFound
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	info, err := store.readInfo(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(store.blobPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, errMediaNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+func (store *MediaStore) Delete(id string) error {
+	if !isValidMediaID(id) {
+		return errMediaNotFound
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := os.Remove(store.blobPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(store.metaPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// ServeUpload handles POST /media. It accepts either a multipart form with a
+// "file" field or the raw bytes as the request body, in which case the file
+// name can be passed with the "name" query parameter.
+func (store *MediaStore) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, store.maxSize+multipartOverhead)
+
+	var (
+		info *MediaInfo
+		err  error
+	)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		info, err = store.saveMultipart(r)
+	} else {
+		info, err = store.Save(r.Body, r.URL.Query().Get("name"))
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, errMediaTooLarge), errors.As(err, &maxBytesErr):
+			http.Error(w, errMediaTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errMediaEmpty), errors.Is(err, http.ErrMissingFile):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			slog.Error("Error saving media upload", "error", err)
+			http.Error(w, "failed to store media", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := store.addImageMetadata(info); err != nil {
+		slog.Warn("Error creating thumbnail", "mediaId", info.ID, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// ServeMediaUpload handles POST /media for the clients of server. Like
+// /search, an upload needs the session token the client got on /ws.
+func (server *WsServer) ServeMediaUpload(w http.ResponseWriter, r *http.Request) {
+	if server.authenticatedClient(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	server.media.ServeUpload(w, r)
+}
+
+func (store *MediaStore) saveMultipart(r *http.Request) (*MediaInfo, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() != mediaFormFieldName {
+			part.Close()
+			continue
+		}
+
+		info, err := store.Save(part, part.FileName())
+		part.Close()
+		return info, err
+	}
+}
+
+// ServeDownload handles GET /media/{id}.
+func (store *MediaStore) ServeDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/media/")
+
+	file, info, err := store.Open(id)
+	if errors.Is(err, errMediaNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("Error opening media", "mediaId", id, "error", err)
+		http.Error(w, "failed to read media", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Uploads are served from the chat's own origin, so anything a browser
+	// could run, such as HTML, is only offered as a download.
+	contentType, disposition := info.ContentType, "inline"
+	if !servedInline(contentType) {
+		contentType, disposition = "application/octet-stream", "attachment"
+	}
+	params := map[string]string{}
+	if info.FileName != "" {
+		params["filename"] = info.FileName
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf("%q", info.ID))
+
+	http.ServeContent(w, r, "", info.CreatedAt, file)
+}
+
+// servedInline reports whether media of the given type may be shown by the
+// browser rather than downloaded. SVG images can carry scripts.
+func servedInline(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "image/svg+xml" {
+		return false
+	}
+
+	switch strings.SplitN(mediaType, "/", 2)[0] {
+	case "image", "audio", "video":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func newTestMediaStore(t *testing.T, maxSize int64) *MediaStore {
+	store, err := NewMediaStore(t.TempDir(), maxSize)
+	require.NoError(t, err)
+	return store
+}
+
+func TestMediaStore_SaveDeduplicates(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+
+	first, err := store.Save(bytes.NewReader([]byte("hello world")), "a.txt")
+	require.NoError(t, err)
+	second, err := store.Save(bytes.NewReader([]byte("hello world")), "b.txt")
+	require.NoError(t, err)
+
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, int64(11), first.Size)
+	assert.Equal(t, "text/plain; charset=utf-8", first.ContentType)
+	assert.Equal(t, "a.txt", second.FileName)
+}
+
+func TestMediaStore_SaveTooLarge(t *testing.T) {
+	store := newTestMediaStore(t, 4)
+
+	_, err := store.Save(strings.NewReader("too large"), "")
+	assert.ErrorIs(t, err, errMediaTooLarge)
+}
+
+func TestMediaStore_StatRejectsInvalidID(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+
+	_, err := store.Stat("../../etc/passwd")
+	assert.ErrorIs(t, err, errMediaNotFound)
+}
+
+func TestMediaStore_Delete(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+	info, err := store.Save(strings.NewReader("bye"), "")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Delete(info.ID))
+
+	_, err = store.Stat(info.ID)
+	assert.ErrorIs(t, err, errMediaNotFound)
+}
+
+func TestMediaStore_UploadMultipartAndDownload(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+	content := append(append([]byte{}, pngHeader...), []byte("not really a png")...)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "picture.png")
+	require.NoError(t, err)
+	part.Write(content)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/media", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	store.ServeUpload(rec, req)
+
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var info MediaInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, "image/png", info.ContentType)
+	assert.Equal(t, "picture.png", info.FileName)
+
+	req = httptest.NewRequest(http.MethodGet, "/media/"+info.ID, nil)
+	rec = httptest.NewRecorder()
+	store.ServeDownload(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename=picture.png`, rec.Header().Get("Content-Disposition"))
+	data, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, content, data)
+}
+
+func TestMediaStore_DownloadHTMLAsAttachment(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+	info, err := store.Save(strings.NewReader("<html><script>alert(document.cookie)</script></html>"), "page.html")
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", info.ContentType)
+
+	req := httptest.NewRequest(http.MethodGet, "/media/"+info.ID, nil)
+	rec := httptest.NewRecorder()
+	store.ServeDownload(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=page.html`, rec.Header().Get("Content-Disposition"))
+	assert.Contains(t, rec.Header().Get("Content-Security-Policy"), "sandbox")
+}
+
+func TestServedInline(t *testing.T) {
+	assert.True(t, servedInline("image/png"))
+	assert.True(t, servedInline("audio/ogg"))
+	assert.True(t, servedInline("video/webm"))
+	assert.False(t, servedInline("image/svg+xml"))
+	assert.False(t, servedInline("text/html; charset=utf-8"))
+	assert.False(t, servedInline("application/pdf"))
+	assert.False(t, servedInline(""))
+}
+
+func TestMediaStore_UploadRawBodyTooLarge(t *testing.T) {
+	store := newTestMediaStore(t, 8)
+
+	req := httptest.NewRequest(http.MethodPost, "/media?name=big.bin", strings.NewReader("0123456789"))
+	rec := httptest.NewRecorder()
+	store.ServeUpload(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestMediaStore_DownloadUnknown(t *testing.T) {
+	store := newTestMediaStore(t, 1024)
+
+	req := httptest.NewRequest(http.MethodGet, "/media/"+strings.Repeat("a", 64), nil)
+	rec := httptest.NewRecorder()
+	store.ServeDownload(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServeMediaUpload_NeedsSessionToken(t *testing.T) {
+	server := NewWebsocketServer()
+	server.media = newTestMediaStore(t, 1024)
+	client := connectedClients(server, "alice")[0]
+
+	upload := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/media?name=note.txt", strings.NewReader("hello"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeMediaUpload(rec, req)
+		return rec
+	}
+
+	rec := upload("")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, upload(client.ID.String()).Code)
+	assert.Equal(t, http.StatusCreated, upload(client.token).Code)
+}
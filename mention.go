@@ -0,0 +1,234 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mentionRoom          = "room"
+	mentionHere          = "here"
+	maxUnreadMentions    = 100
+	mentionNamePattern   = `[\p{L}\p{N}_.\-]+`
+	mentionPrefixPattern = `(?:^|[^\p{L}\p{N}_@])`
+)
+
+var mentionPattern = regexp.MustCompile(mentionPrefixPattern + `@(` + mentionNamePattern + `)`)
+
+// parseMentions returns the names and IDs mentioned in text, without the
+// leading @ and without duplicates.
+func parseMentions(text string) []string {
+	mentions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		mention := strings.TrimRight(match[1], ".-")
+		key := strings.ToLower(mention)
+		if mention == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		mentions = append(mentions, mention)
+	}
+
+	return mentions
+}
+
+// resolveMentions turns the mentions in a message sent to room into client
+// IDs. Names and IDs are matched against the room's members, so people
+// outside the room cannot be sent its messages by mentioning them. @room
+// mentions every member and @here every member that is online and not away.
+// The sender is never mentioned.
+func (server *WsServer) resolveMentions(room *Room, text string, sender *Client) []uuid.UUID {
+	mentions := parseMentions(text)
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	resolved := make([]uuid.UUID, 0)
+	seen := map[uuid.UUID]bool{sender.ID: true}
+	add := func(id uuid.UUID) {
+		if !seen[id] {
+			seen[id] = true
+			resolved = append(resolved, id)
+		}
+	}
+
+	for _, mention := range mentions {
+		switch strings.ToLower(mention) {
+		case mentionRoom:
+			for _, member := range room.members() {
+				add(member.ID)
+			}
+			continue
+		case mentionHere:
+			for _, member := range room.members() {
+				if server.isOnline(member.ID) && member.visiblePresence() == PresenceOnline {
+					add(member.ID)
+				}
+			}
+			continue
+		}
+
+		if id, err := uuid.Parse(mention); err == nil {
+			if room.hasClientID(id) {
+				add(id)
+			}
+			continue
+		}
+
+		for _, member := range room.members() {
+			if strings.EqualFold(member.Name, mention) {
+				add(member.ID)
+			}
+		}
+	}
+
+	return resolved
+}
+
+// notifyMentions sends a mention event to every client mentioned in
+// message, whether or not they are in the room, and records it as unread so
+// clients that are offline get it when they reconnect. Clients who blocked
+// the sender are not told.
+func (server *WsServer) notifyMentions(message *Message) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+
+	notification := *message
+	notification.Action = MentionAction
+	notification.AudioData = nil
+
+	for _, id := range message.Mentions {
+		if message.Sender != nil && server.blocks.isBlocked(id, message.Sender.ID) {
+			continue
+		}
+		server.mentions.add(id, notification)
+
+		if client := server.clientByID(id); client != nil {
+			client.enqueue(notification.encode())
+		}
+	}
+}
+
+// MentionTracker remembers the mentions each user has not read yet, keyed by
+// user ID so they survive reconnects.
+type MentionTracker struct {
+	mu     sync.Mutex
+	unread map[uuid.UUID][]Message
+}
+
+func NewMentionTracker() *MentionTracker {
+	return &MentionTracker{
+		unread: make(map[uuid.UUID][]Message),
+	}
+}
+
+func (tracker *MentionTracker) add(userID uuid.UUID, message Message) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	unread := append(tracker.unread[userID], message)
+	if len(unread) > maxUnreadMentions {
+		unread = unread[len(unread)-maxUnreadMentions:]
+	}
+	tracker.unread[userID] = unread
+}
+
+func (tracker *MentionTracker) list(userID uuid.UUID) []Message {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	unread := make([]Message, len(tracker.unread[userID]))
+	copy(unread, tracker.unread[userID])
+
+	return unread
+}
+
+// markRead clears the unread mentions of userID in roomID, or in every room
+// if roomID is empty.
+func (tracker *MentionTracker) markRead(userID uuid.UUID, roomID string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if roomID == "" {
+		delete(tracker.unread, userID)
+		return
+	}
+
+	remaining := make([]Message, 0)
+	for _, message := range tracker.unread[userID] {
+		if message.Target == nil || message.Target.GetId() != roomID {
+			remaining = append(remaining, message)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(tracker.unread, userID)
+		return
+	}
+	tracker.unread[userID] = remaining
+}
+
+// removeMessage forgets every unread mention of a deleted message.
+func (tracker *MentionTracker) removeMessage(messageID uuid.UUID) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	for userID, unread := range tracker.unread {
+		remaining := make([]Message, 0, len(unread))
+		for _, message := range unread {
+			if message.ID != messageID {
+				remaining = append(remaining, message)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(tracker.unread, userID)
+		} else {
+			tracker.unread[userID] = remaining
+		}
+	}
+}
+
+// removeRoom forgets every unread mention in a deleted room.
+func (tracker *MentionTracker) removeRoom(roomID uuid.UUID) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	for userID, unread := range tracker.unread {
+		remaining := make([]Message, 0, len(unread))
+		for _, message := range unread {
+			if message.Target == nil || message.Target.ID != roomID {
+				remaining = append(remaining, message)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(tracker.unread, userID)
+		} else {
+			tracker.unread[userID] = remaining
+		}
+	}
+}
+
+func (client *Client) sendUnreadMentions() {
+	unreadMsg := &UnreadMentionsMessage{
+		Action:   UnreadMentionsAction,
+		Mentions: messageViews(client.wsServer.mentions.list(client.ID)),
+	}
+	client.enqueue(unreadMsg.encode())
+}
+
+func (client *Client) handleMarkMentionsReadMessage(message Message) {
+	roomID := ""
+	if message.Target != nil {
+		roomID = message.Target.GetId()
+	}
+
+	client.wsServer.mentions.markRead(client.ID, roomID)
+	client.sendUnreadMentions()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMentions(t *testing.T) {
+	id := uuid.New()
+
+	mentions := parseMentions("hey @Alice and @bob. ping @" + id.String() + " @alice mail me at bob@example.com @here")
+
+	assert.Equal(t, []string{"Alice", "bob", id.String(), "here"}, mentions)
+}
+
+func TestResolveMentions(t *testing.T) {
+	server := NewWebsocketServer()
+	room := NewRoom("general", false, nil)
+	sender := newClient(nil, server, "Sender")
+	alice := newClient(nil, server, "Alice")
+	bob := newClient(nil, server, "Bob")
+	outsider := newClient(nil, server, "Outsider")
+	for _, client := range []*Client{sender, alice, bob} {
+		room.registerClientInRoom(client)
+	}
+	server.addClient(sender)
+	server.addClient(alice)
+	server.addClient(outsider)
+
+	assert.Equal(t, []uuid.UUID{alice.ID}, server.resolveMentions(room, "hi @alice", sender))
+	assert.Empty(t, server.resolveMentions(room, "hi @outsider @sender", sender))
+	assert.Equal(t, []uuid.UUID{bob.ID}, server.resolveMentions(room, "hi @"+bob.ID.String(), sender))
+	assert.Empty(t, server.resolveMentions(room, "hi @"+outsider.ID.String(), sender), "Expected online non-members not to be mentioned")
+	assert.Equal(t, []uuid.UUID{alice.ID}, server.resolveMentions(room, "@here", sender))
+	assert.ElementsMatch(t, []uuid.UUID{alice.ID, bob.ID}, server.resolveMentions(room, "@room", sender))
+}
+
+func TestNotifyMentions(t *testing.T) {
+	server := NewWebsocketServer()
+	room := NewRoom("general", false, nil)
+	sender := newClient(nil, server, "Sender")
+	online := newClient(nil, server, "Online")
+	offlineID := uuid.New()
+	server.addClient(online)
+
+	server.notifyMentions(&Message{
+		Action:   SendMessageAction,
+		Message:  "hello",
+		Target:   room,
+		Sender:   sender,
+		Mentions: []uuid.UUID{online.ID, offlineID},
+	})
+
+	require.Len(t, online.send, 1)
+	var notification Message
+	require.NoError(t, json.Unmarshal(<-online.send, &notification))
+	assert.Equal(t, MentionAction, notification.Action)
+	assert.Equal(t, "hello", notification.Message)
+
+	assert.Len(t, server.mentions.list(online.ID), 1)
+	assert.Len(t, server.mentions.list(offlineID), 1)
+}
+
+func TestMentionTracker_markRead(t *testing.T) {
+	tracker := NewMentionTracker()
+	userID := uuid.New()
+	general := NewRoom("general", false, nil)
+	random := NewRoom("random", false, nil)
+
+	tracker.add(userID, Message{Target: general})
+	tracker.add(userID, Message{Target: random})
+
+	tracker.markRead(userID, general.GetId())
+	unread := tracker.list(userID)
+	require.Len(t, unread, 1)
+	assert.Equal(t, random, unread[0].Target)
+
+	tracker.markRead(userID, "")
+	assert.Empty(t, tracker.list(userID))
+}
+
+func TestMentionTracker_keepsLatest(t *testing.T) {
+	tracker := NewMentionTracker()
+	userID := uuid.New()
+
+	for i := 0; i < maxUnreadMentions+5; i++ {
+		tracker.add(userID, Message{})
+	}
+
+	assert.Len(t, tracker.list(userID), maxUnreadMentions)
+}
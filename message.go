@@ -2,46 +2,254 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 const SendMessageAction = "send-message"
 const SendAudioMessageAction = "send-audio-message"
+const AudioMessageAction = "audio-message"
 const JoinRoomAction = "join-room"
 const LeaveRoomAction = "leave-room"
-const UserJoinedAction = "user-join"
+const UserJoinedAction = "user-joined"
 const UserLeftAction = "user-left"
+const GetOnlineUsersAction = "get-online-users"
+const OnlineUsersAction = "online-users"
+const RoomMemberAddedAction = "room-member-added"
+const RoomMemberRemovedAction = "room-member-removed"
+const RoomClientsListAction = "room-clients-list"
 const JoinRoomPrivateAction = "join-room-private"
+const CreateDMAction = "create-dm"
+const AddDMParticipantsAction = "add-dm-participants"
 const RoomJoinedAction = "room-joined"
 const TypingAction = "typing-action"
 const UserLoggedInAction = "user-logged-in"
 const DeleteRoomAction = "delete-room"
+const UpdateRoomAction = "update-room"
+const RenameRoomAction = "rename-room"
+const RoomUpdatedAction = "room-updated"
+const RoomDeletedAction = "room-deleted"
+const SystemAnnouncementAction = "system-announcement"
+const SystemAnnouncementWithdrawnAction = "system-announcement-withdrawn"
+const SetRetentionAction = "set-retention"
+const RetentionUpdatedAction = "retention-updated"
+const SearchMessagesAction = "search-messages"
+const SearchResultsAction = "search-results"
+const MentionAction = "mention"
+const UnreadMentionsAction = "unread-mentions"
+const MarkMentionsReadAction = "mark-mentions-read"
+const SetPresenceAction = "set-presence"
+const PresenceUpdateAction = "presence-update"
+const BlockUserAction = "block-user"
+const UnblockUserAction = "unblock-user"
+const BlockedUsersAction = "blocked-users"
+const SetFiltersAction = "set-filters"
+const FiltersUpdatedAction = "filters-updated"
+const ErrorAction = "error"
+const ReportMessageAction = "report-message"
+const MessageReportedAction = "message-reported"
+const MessageDeletedAction = "message-deleted"
+const RemovedFromRoomAction = "removed-from-room"
 
 type Message struct {
-	Action    string  `json:"action"`
-	Message   string  `json:"message"`
-	Target    *Room   `json:"target"`
-	Sender    *Client `json:"sender"`
-	Timestamp string  `json:"timestamp"`
-	AudioData []byte  `json:"audioData"`
+	ID           uuid.UUID        `json:"id"`
+	Action       string           `json:"action"`
+	Message      string           `json:"message"`
+	Target       *Room            `json:"target"`
+	Sender       *Client          `json:"sender"`
+	Timestamp    string           `json:"timestamp"`
+	AudioData    []byte           `json:"audioData"`
+	AttachmentID string           `json:"attachmentId,omitempty"`
+	Attachments  []Attachment     `json:"attachments,omitempty"`
+	MimeType     string           `json:"mimeType,omitempty"`
+	DurationMs   int64            `json:"durationMs,omitempty"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	Retention    *RetentionPolicy `json:"retention,omitempty"`
+	Search       *SearchQuery     `json:"search,omitempty"`
+	Mentions     []uuid.UUID      `json:"mentions,omitempty"`
+	RoomUpdate   *RoomUpdate      `json:"room,omitempty"`
+	Participants []uuid.UUID      `json:"participants,omitempty"`
+	Filters      *FilterPolicy    `json:"filters,omitempty"`
+	Report       *ReportRequest   `json:"report,omitempty"`
+}
+
+// RoomSummary is how a room is sent to clients.
+type RoomSummary struct {
+	ID          uuid.UUID       `json:"id"`
+	Name        string          `json:"name"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Topic       string          `json:"topic,omitempty"`
+	Description string          `json:"description,omitempty"`
+	AvatarColor string          `json:"avatarColor,omitempty"`
+	Private     bool            `json:"private"`
+	Ephemeral   bool            `json:"ephemeral"`
+	OwnerID     *uuid.UUID      `json:"ownerId,omitempty"`
+	MemberCount int             `json:"memberCount"`
+	Retention   RetentionPolicy `json:"retention"`
+}
+
+// UserSummary is how a client is sent to other clients.
+type UserSummary struct {
+	ID          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	AvatarColor string    `json:"avatarColor"`
+	Presence    string    `json:"presence"`
+}
+
+// MessageView is how a Message is sent to clients. Its room and sender are
+// summarized, so their members and history are never sent along.
+type MessageView struct {
+	ID           uuid.UUID        `json:"id"`
+	Action       string           `json:"action"`
+	Message      string           `json:"message"`
+	Target       *RoomSummary     `json:"target"`
+	Sender       *UserSummary     `json:"sender"`
+	Timestamp    string           `json:"timestamp"`
+	AudioData    []byte           `json:"audioData,omitempty"`
+	AttachmentID string           `json:"attachmentId,omitempty"`
+	Attachments  []Attachment     `json:"attachments,omitempty"`
+	MimeType     string           `json:"mimeType,omitempty"`
+	DurationMs   int64            `json:"durationMs,omitempty"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	Retention    *RetentionPolicy `json:"retention,omitempty"`
+	Mentions     []uuid.UUID      `json:"mentions,omitempty"`
+}
+
+func (message *Message) view() MessageView {
+	view := MessageView{
+		ID:           message.ID,
+		Action:       message.Action,
+		Message:      message.Message,
+		Timestamp:    message.Timestamp,
+		AudioData:    message.AudioData,
+		AttachmentID: message.AttachmentID,
+		Attachments:  message.Attachments,
+		MimeType:     message.MimeType,
+		DurationMs:   message.DurationMs,
+		CreatedAt:    message.CreatedAt,
+		Retention:    message.Retention,
+		Mentions:     message.Mentions,
+	}
+	if message.Target != nil {
+		target := message.Target.summary()
+		view.Target = &target
+	}
+	if message.Sender != nil {
+		sender := message.Sender.summary()
+		view.Sender = &sender
+	}
+
+	return view
+}
+
+func messageViews(messages []Message) []MessageView {
+	views := make([]MessageView, 0, len(messages))
+	for i := range messages {
+		views = append(views, messages[i].view())
+	}
+
+	return views
+}
+
+func roomSummaries(rooms []*Room) []RoomSummary {
+	summaries := make([]RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, room.summary())
+	}
+
+	return summaries
 }
+
+func userSummaries(clients []*Client) []UserSummary {
+	summaries := make([]UserSummary, 0, len(clients))
+	for _, client := range clients {
+		summaries = append(summaries, client.summary())
+	}
+
+	return summaries
+}
+
 type RoomListMessage struct {
-	Action   string  `json:"action"`
-	RoomList []*Room `json:"rooms"`
+	Action   string        `json:"action"`
+	RoomList []RoomSummary `json:"rooms"`
 }
 type RoomClientsListMessage struct {
-	Action          string    `json:"action"`
-	RoomClientsList []*Client `json:"clients"`
+	Action          string        `json:"action"`
+	RoomClientsList []UserSummary `json:"clients"`
+}
+type RoomJoinedMessage struct {
+	Action   string        `json:"action"`
+	Target   RoomSummary   `json:"target"`
+	Sender   *UserSummary  `json:"sender"`
+	Messages []MessageView `json:"messages"`
+}
+type SearchResultsMessage struct {
+	Action string `json:"action"`
+	SearchResults
+}
+type UnreadMentionsMessage struct {
+	Action   string        `json:"action"`
+	Mentions []MessageView `json:"mentions"`
+}
+type PresenceUpdateMessage struct {
+	Action   string     `json:"action"`
+	UserID   uuid.UUID  `json:"userId"`
+	Name     string     `json:"name"`
+	Presence string     `json:"presence"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+type ClientEventMessage struct {
+	Action   string      `json:"action"`
+	Client   UserSummary `json:"client"`
+	RoomID   *uuid.UUID  `json:"roomId,omitempty"`
+	LastSeen *time.Time  `json:"lastSeen,omitempty"`
+}
+type RoomEventMessage struct {
+	Action string    `json:"action"`
+	RoomID uuid.UUID `json:"roomId"`
+	Name   string    `json:"name"`
+}
+type BlockedUsersMessage struct {
+	Action  string      `json:"action"`
+	UserIDs []uuid.UUID `json:"userIds"`
+}
+type FiltersUpdatedMessage struct {
+	Action  string       `json:"action"`
+	RoomID  uuid.UUID    `json:"roomId"`
+	Filters FilterPolicy `json:"filters"`
+}
+type ErrorMessage struct {
+	Action        string       `json:"action"`
+	RequestAction string       `json:"requestAction"`
+	Error         string       `json:"error"`
+	Target        *RoomSummary `json:"target,omitempty"`
+}
+type MessageReportedMessage struct {
+	Action    string    `json:"action"`
+	ReportID  uuid.UUID `json:"reportId"`
+	MessageID uuid.UUID `json:"messageId"`
+}
+type LoggedInMessage struct {
+	Action string      `json:"action"`
+	Sender UserSummary `json:"sender"`
+	Token  string      `json:"token"`
 }
 type ClientsListMessage struct {
-	Action      string    `json:"action"`
-	ClientsList []*Client `json:"clients"`
+	Action      string        `json:"action"`
+	ClientsList []UserSummary `json:"clients"`
+}
+
+type AnnouncementMessage struct {
+	Action       string        `json:"action"`
+	Announcement *Announcement `json:"announcement"`
 }
 
 func (message *Message) encode() []byte {
-	json, err := json.Marshal(message)
+	json, err := json.Marshal(message.view())
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error encoding message", "action", message.Action, "error", err)
 	}
 
 	return json
@@ -50,7 +258,16 @@ func (message *Message) encode() []byte {
 func (roomListMessage *RoomListMessage) encode() []byte {
 	json, err := json.Marshal(roomListMessage)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error encoding message", "action", roomListMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (roomJoinedMessage *RoomJoinedMessage) encode() []byte {
+	json, err := json.Marshal(roomJoinedMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", roomJoinedMessage.Action, "error", err)
 	}
 
 	return json
@@ -59,7 +276,7 @@ func (roomListMessage *RoomListMessage) encode() []byte {
 func (roomListMessage *RoomClientsListMessage) encode() []byte {
 	json, err := json.Marshal(roomListMessage)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error encoding message", "action", roomListMessage.Action, "error", err)
 	}
 
 	return json
@@ -68,7 +285,106 @@ func (roomListMessage *RoomClientsListMessage) encode() []byte {
 func (clientsListMessage *ClientsListMessage) encode() []byte {
 	json, err := json.Marshal(clientsListMessage)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error encoding message", "action", clientsListMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (searchResultsMessage *SearchResultsMessage) encode() []byte {
+	json, err := json.Marshal(searchResultsMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", searchResultsMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (unreadMentionsMessage *UnreadMentionsMessage) encode() []byte {
+	json, err := json.Marshal(unreadMentionsMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", unreadMentionsMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (presenceUpdateMessage *PresenceUpdateMessage) encode() []byte {
+	json, err := json.Marshal(presenceUpdateMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", presenceUpdateMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (clientEventMessage *ClientEventMessage) encode() []byte {
+	json, err := json.Marshal(clientEventMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", clientEventMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (roomEventMessage *RoomEventMessage) encode() []byte {
+	json, err := json.Marshal(roomEventMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", roomEventMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (blockedUsersMessage *BlockedUsersMessage) encode() []byte {
+	json, err := json.Marshal(blockedUsersMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", blockedUsersMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (filtersUpdatedMessage *FiltersUpdatedMessage) encode() []byte {
+	json, err := json.Marshal(filtersUpdatedMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", filtersUpdatedMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (errorMessage *ErrorMessage) encode() []byte {
+	json, err := json.Marshal(errorMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", errorMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (messageReportedMessage *MessageReportedMessage) encode() []byte {
+	json, err := json.Marshal(messageReportedMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", messageReportedMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (loggedInMessage *LoggedInMessage) encode() []byte {
+	json, err := json.Marshal(loggedInMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", loggedInMessage.Action, "error", err)
+	}
+
+	return json
+}
+
+func (announcementMessage *AnnouncementMessage) encode() []byte {
+	json, err := json.Marshal(announcementMessage)
+	if err != nil {
+		slog.Error("Error encoding message", "action", announcementMessage.Action, "error", err)
 	}
 
 	return json
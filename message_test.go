@@ -49,3 +49,65 @@ func TestMessageEncode(t *testing.T) {
 		t.Errorf("Expected timestamp %s, got %s", message.Timestamp, decodedMessage.Timestamp)
 	}
 }
+
+func TestMessageEncode_SummarizesRoomAndSender(t *testing.T) {
+	owner := newClient(nil, nil, "owner")
+	room := NewRoom("Test Room", false, owner)
+	room.registerClientInRoom(owner)
+	room.storeMessage(Message{Message: "history"})
+	message := &Message{Action: SendMessageAction, Message: "hello", Target: room, Sender: owner}
+
+	var encoded map[string]json.RawMessage
+	if err := json.Unmarshal(message.encode(), &encoded); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+
+	var target map[string]interface{}
+	if err := json.Unmarshal(encoded["target"], &target); err != nil {
+		t.Fatalf("Failed to decode target: %v", err)
+	}
+	for _, field := range []string{"clients", "messages", "owner"} {
+		if _, ok := target[field]; ok {
+			t.Errorf("Expected the target not to include %s", field)
+		}
+	}
+	if target["memberCount"] != float64(1) || target["ownerId"] != owner.ID.String() {
+		t.Errorf("Expected the target to summarize the room, got %v", target)
+	}
+
+	var sender map[string]interface{}
+	if err := json.Unmarshal(encoded["sender"], &sender); err != nil {
+		t.Fatalf("Failed to decode sender: %v", err)
+	}
+	if _, ok := sender["rooms"]; ok {
+		t.Error("Expected the sender not to include its rooms")
+	}
+	if sender["presence"] != PresenceOnline {
+		t.Errorf("Expected sender presence %s, got %v", PresenceOnline, sender["presence"])
+	}
+	if _, ok := encoded["search"]; ok {
+		t.Error("Expected no search query in an outgoing message")
+	}
+}
+
+func TestNotifyRoomJoined_SendsHistory(t *testing.T) {
+	client := newClient(nil, nil, "test")
+	room := NewRoom("Test Room", false, nil)
+	room.storeMessage(Message{ID: uuid.New(), Action: SendMessageAction, Message: "earlier", Target: room, Sender: client})
+
+	client.notifyRoomJoined(room, client)
+
+	var joined RoomJoinedMessage
+	if err := json.Unmarshal(<-client.send, &joined); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	if joined.Action != RoomJoinedAction || joined.Target.ID != room.ID {
+		t.Errorf("Expected a %s event for the room, got %s", RoomJoinedAction, joined.Action)
+	}
+	if joined.Sender == nil || joined.Sender.ID != client.ID {
+		t.Error("Expected the sender to be summarized")
+	}
+	if len(joined.Messages) != 1 || joined.Messages[0].Message != "earlier" {
+		t.Errorf("Expected the room history, got %v", joined.Messages)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The collectors below write the Prometheus text exposition format. They
+// cover just what this server reports, so the server does not need the
+// Prometheus client library.
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type Gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func (gauge *Gauge) Set(value float64) {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+
+	gauge.value = value
+}
+
+func (gauge *Gauge) Value() float64 {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+
+	return gauge.value
+}
+
+func (gauge *Gauge) writeTo(w io.Writer) {
+	writeHeader(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatFloat(gauge.Value()))
+}
+
+type Counter struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func (counter *Counter) Add(value float64) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	counter.value += value
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Value() float64 {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	return counter.value
+}
+
+func (counter *Counter) writeTo(w io.Writer) {
+	writeHeader(w, counter.name, counter.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", counter.name, formatFloat(counter.Value()))
+}
+
+// CounterVec is a counter partitioned by the value of a single label.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (vec *CounterVec) Add(labelValue string, value float64) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	vec.values[labelValue] += value
+}
+
+func (vec *CounterVec) Inc(labelValue string) {
+	vec.Add(labelValue, 1)
+}
+
+func (vec *CounterVec) Value(labelValue string) float64 {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	return vec.values[labelValue]
+}
+
+func (vec *CounterVec) writeTo(w io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	writeHeader(w, vec.name, vec.help, "counter")
+
+	labelValues := make([]string, 0, len(vec.values))
+	for labelValue := range vec.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", vec.name, vec.label, labelValueEscaper.Replace(labelValue), formatFloat(vec.values[labelValue]))
+	}
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	for i, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+func (histogram *Histogram) ObserveSince(start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
+
+func (histogram *Histogram) Count() uint64 {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	return histogram.count
+}
+
+func (histogram *Histogram) writeTo(w io.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+	for i, upperBound := range histogram.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", histogram.name, formatFloat(upperBound), histogram.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram.name, histogram.count)
+	fmt.Fprintf(w, "%s_sum %s\n", histogram.name, formatFloat(histogram.sum))
+	fmt.Fprintf(w, "%s_count %d\n", histogram.name, histogram.count)
+}
+
+// Metrics holds everything the server exposes on /metrics.
+type Metrics struct {
+	ConnectedClients      *Gauge
+	Rooms                 *Gauge
+	InboundActions        *CounterVec
+	MessageBytes          *CounterVec
+	SendsDropped          *CounterVec
+	SlowConsumerEvictions *Counter
+	UpgradeFailures       *Counter
+	BroadcastFanout       *Histogram
+
+	collectors []collector
+}
+
+func NewMetrics() *Metrics {
+	fanoutBuckets := []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+	metrics := &Metrics{
+		ConnectedClients: &Gauge{name: "chat_connected_clients", help: "Number of connected clients."},
+		Rooms:            &Gauge{name: "chat_rooms", help: "Number of rooms."},
+		InboundActions: &CounterVec{
+			name:   "chat_inbound_actions_total",
+			help:   "Messages received from clients by action.",
+			label:  "action",
+			values: make(map[string]float64),
+		},
+		MessageBytes: &CounterVec{
+			name:   "chat_message_bytes_total",
+			help:   "WebSocket message bytes by direction.",
+			label:  "direction",
+			values: make(map[string]float64),
+		},
+		SendsDropped: &CounterVec{
+			name:   "chat_sends_dropped_total",
+			help:   "Messages for a client that were never written, by reason.",
+			label:  "reason",
+			values: make(map[string]float64),
+		},
+		SlowConsumerEvictions: &Counter{name: "chat_slow_consumer_evictions_total", help: "Clients disconnected because their send buffer overflowed."},
+		UpgradeFailures:       &Counter{name: "chat_upgrade_failures_total", help: "WebSocket connection requests that could not be upgraded."},
+		BroadcastFanout: &Histogram{
+			name:    "chat_broadcast_fanout_seconds",
+			help:    "Time taken to hand a room broadcast to every member.",
+			buckets: fanoutBuckets,
+			counts:  make([]uint64, len(fanoutBuckets)),
+		},
+	}
+
+	metrics.collectors = []collector{
+		metrics.ConnectedClients,
+		metrics.Rooms,
+		metrics.InboundActions,
+		metrics.MessageBytes,
+		metrics.SendsDropped,
+		metrics.SlowConsumerEvictions,
+		metrics.UpgradeFailures,
+		metrics.BroadcastFanout,
+	}
+
+	return metrics
+}
+
+var metrics = NewMetrics()
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range metrics.collectors {
+		c.writeTo(w)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.ConnectedClients.Set(2)
+	m.InboundActions.Inc(SendMessageAction)
+	m.InboundActions.Inc(SendMessageAction)
+	m.InboundActions.Inc("say \"hi\"")
+	m.UpgradeFailures.Inc()
+	m.BroadcastFanout.Observe(0.002)
+	m.BroadcastFanout.Observe(2)
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "version=0.0.4")
+
+	body := rr.Body.String()
+	assert.Contains(t, body, "# TYPE chat_connected_clients gauge\nchat_connected_clients 2\n")
+	assert.Contains(t, body, "chat_inbound_actions_total{action=\"send-message\"} 2\n")
+	assert.Contains(t, body, "chat_inbound_actions_total{action=\"say \\\"hi\\\"\"} 1\n")
+	assert.Contains(t, body, "chat_upgrade_failures_total 1\n")
+	assert.Contains(t, body, "# TYPE chat_broadcast_fanout_seconds histogram\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_bucket{le=\"0.001\"} 0\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_bucket{le=\"0.005\"} 1\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_bucket{le=\"5\"} 2\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_sum 2.002\n")
+	assert.Contains(t, body, "chat_broadcast_fanout_seconds_count 2\n")
+}
+
+func TestHandleNewMessage_CountsActions(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	before := metrics.InboundActions.Value("unknown")
+
+	client.handleNewMessage([]byte(`{"action":"no-such-action"}`))
+
+	assert.Equal(t, before+1, metrics.InboundActions.Value("unknown"))
+}
+
+func TestCreateRoom_UpdatesRoomsGauge(t *testing.T) {
+	server := NewWebsocketServer()
+
+	room := server.createRoom("metrics", false, nil)
+	assert.Equal(t, float64(1), metrics.Rooms.Value())
+
+	server.deleteRoom(room)
+	assert.Equal(t, float64(0), metrics.Rooms.Value())
+}
+
+func TestBroadcastToClientsInRoom_ObservesFanout(t *testing.T) {
+	room := NewRoom("metrics", false, nil)
+	client := newClient(nil, nil, "test")
+	room.registerClientInRoom(client)
+	before := metrics.BroadcastFanout.Count()
+
+	room.broadcastToClientsInRoom([]byte("hello"))
+
+	assert.Equal(t, before+1, metrics.BroadcastFanout.Count())
+	assert.Equal(t, []byte("hello"), <-client.send)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens when a message is sent to a client whose send buffer is full.
+const (
+	// OverflowDropOldest discards the oldest queued message to make room.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowCoalescePresence keeps only the latest presence update per
+	// user while the buffer is full and drops the oldest message otherwise.
+	OverflowCoalescePresence = "coalesce-presence"
+	// OverflowDisconnect closes the connection of the slow client.
+	OverflowDisconnect = "disconnect"
+)
+
+// CloseSlowConsumer is the close code sent to clients that are disconnected
+// because they could not keep up.
+const CloseSlowConsumer = 4000
+
+func isOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowDropOldest, OverflowCoalescePresence, OverflowDisconnect:
+		return true
+	}
+	return false
+}
+
+// enqueue queues message for the client without blocking. When the send
+// buffer is full the client's overflow policy decides what gives.
+func (client *Client) enqueue(message []byte) {
+	client.enqueueKeyed(message, "")
+}
+
+// enqueueKeyed is enqueue for messages that a later message with the same
+// key supersedes, such as presence updates for one user.
+func (client *Client) enqueueKeyed(message []byte, key string) {
+	if client.evicted.Load() {
+		metrics.SendsDropped.Inc("evicted")
+		return
+	}
+
+	coalesce := key != "" && client.overflow == OverflowCoalescePresence
+	if coalesce && client.coalesce(key, message, false) {
+		return
+	}
+
+	select {
+	case client.send <- message:
+		return
+	default:
+	}
+
+	switch {
+	case coalesce:
+		client.coalesce(key, message, true)
+	case client.overflow == OverflowDropOldest, client.overflow == OverflowCoalescePresence:
+		client.dropOldest(message)
+	default:
+		client.evict()
+	}
+}
+
+// coalesce replaces the pending message for key. Unless force is set it only
+// does so when a message for key is already pending, so updates that found
+// room in the send buffer are not reordered.
+func (client *Client) coalesce(key string, message []byte, force bool) bool {
+	client.pendingMu.Lock()
+	_, ok := client.pending[key]
+	if !ok && !force {
+		client.pendingMu.Unlock()
+		return false
+	}
+	client.pending[key] = message
+	client.pendingMu.Unlock()
+
+	if ok {
+		metrics.SendsDropped.Inc("coalesced")
+	}
+
+	select {
+	case client.pendingReady <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+func (client *Client) takePending() [][]byte {
+	client.pendingMu.Lock()
+	defer client.pendingMu.Unlock()
+
+	messages := make([][]byte, 0, len(client.pending))
+	for key, message := range client.pending {
+		messages = append(messages, message)
+		delete(client.pending, key)
+	}
+
+	return messages
+}
+
+func (client *Client) dropOldest(message []byte) {
+	for {
+		select {
+		case client.send <- message:
+			return
+		default:
+		}
+
+		select {
+		case <-client.send:
+			metrics.SendsDropped.Inc("overflow")
+		default:
+		}
+	}
+}
+
+// evict disconnects a client that fell too far behind. The close frame is
+// written in the background so the sender is not held up by the slow
+// connection.
+func (client *Client) evict() {
+	if !client.evicted.CompareAndSwap(false, true) {
+		return
+	}
+
+	metrics.SlowConsumerEvictions.Inc()
+	metrics.SendsDropped.Inc("evicted")
+	client.logger().Warn("Disconnecting slow consumer")
+
+	conn := client.connection()
+	if conn == nil {
+		return
+	}
+
+	go func() {
+		closeMessage := websocket.FormatCloseMessage(CloseSlowConsumer, "slow consumer")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+		conn.Close()
+	}()
+}
+
+// coalesceKey returns the key under which a broadcast supersedes earlier
+// ones, or "" if it does not.
+func coalesceKey(message []byte) string {
+	var update struct {
+		Action string `json:"action"`
+		UserID string `json:"userId"`
+	}
+	if json.Unmarshal(message, &update) != nil || update.Action != PresenceUpdateAction {
+		return ""
+	}
+
+	return "presence:" + update.UserID
+}
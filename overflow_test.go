@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fillSendBuffer(client *Client) {
+	for i := 0; i < cap(client.send); i++ {
+		client.enqueue([]byte(strconv.Itoa(i)))
+	}
+}
+
+func presenceUpdate(userID uuid.UUID, presence string) []byte {
+	update := &PresenceUpdateMessage{Action: PresenceUpdateAction, UserID: userID, Presence: presence}
+	return update.encode()
+}
+
+func TestEnqueue_DropOldest(t *testing.T) {
+	client := newClient(nil, nil, "slow")
+	client.overflow = OverflowDropOldest
+	dropped := metrics.SendsDropped.Value("overflow")
+
+	fillSendBuffer(client)
+	client.enqueue([]byte("newest"))
+
+	assert.False(t, client.evicted.Load())
+	assert.Equal(t, dropped+1, metrics.SendsDropped.Value("overflow"))
+	require.Len(t, client.send, cap(client.send))
+	assert.Equal(t, []byte("1"), <-client.send, "Expected the oldest message to be dropped")
+	for len(client.send) > 1 {
+		<-client.send
+	}
+	assert.Equal(t, []byte("newest"), <-client.send)
+}
+
+func TestEnqueue_CoalescePresence(t *testing.T) {
+	client := newClient(nil, nil, "slow")
+	client.overflow = OverflowCoalescePresence
+	user := uuid.New()
+	other := uuid.New()
+
+	fillSendBuffer(client)
+	client.enqueueKeyed(presenceUpdate(user, PresenceAway), coalesceKey(presenceUpdate(user, PresenceAway)))
+	client.enqueueKeyed(presenceUpdate(other, PresenceAway), coalesceKey(presenceUpdate(other, PresenceAway)))
+	client.enqueueKeyed(presenceUpdate(user, PresenceOnline), coalesceKey(presenceUpdate(user, PresenceOnline)))
+
+	assert.False(t, client.evicted.Load())
+	assert.Len(t, client.send, cap(client.send), "Expected presence updates not to displace queued messages")
+	assert.Len(t, client.pendingReady, 1)
+
+	pending := client.takePending()
+	assert.ElementsMatch(t, [][]byte{presenceUpdate(user, PresenceOnline), presenceUpdate(other, PresenceAway)}, pending)
+	assert.Empty(t, client.takePending())
+}
+
+func TestEnqueue_Disconnect(t *testing.T) {
+	client := newClient(nil, nil, "slow")
+	evictions := metrics.SlowConsumerEvictions.Value()
+
+	fillSendBuffer(client)
+	assert.False(t, client.evicted.Load())
+
+	client.enqueue([]byte("one too many"))
+	client.enqueue([]byte("and another"))
+
+	assert.True(t, client.evicted.Load())
+	assert.Equal(t, evictions+1, metrics.SlowConsumerEvictions.Value())
+	assert.Len(t, client.send, cap(client.send))
+}
+
+func TestCoalesceKey(t *testing.T) {
+	user := uuid.New()
+
+	assert.Equal(t, "presence:"+user.String(), coalesceKey(presenceUpdate(user, PresenceAway)))
+	assert.Equal(t, "", coalesceKey([]byte(`{"action":"send-message","message":"hi"}`)))
+	assert.Equal(t, "", coalesceKey([]byte("not json")))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	PresenceOnline       = "online"
+	PresenceAway         = "away"
+	PresenceDoNotDisturb = "dnd"
+	PresenceInvisible    = "invisible"
+	PresenceOffline      = "offline"
+
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+func isSettablePresence(presence string) bool {
+	switch presence {
+	case PresenceOnline, PresenceAway, PresenceDoNotDisturb, PresenceInvisible:
+		return true
+	}
+	return false
+}
+
+// visiblePresence is the state other clients see. Invisible clients show up
+// as offline and clients that went idle while online show up as away.
+func (client *Client) visiblePresence() string {
+	client.presenceMu.Lock()
+	defer client.presenceMu.Unlock()
+
+	return client.visiblePresenceLocked()
+}
+
+func (client *Client) visiblePresenceLocked() string {
+	switch {
+	case client.status == PresenceInvisible:
+		return PresenceOffline
+	case client.status == PresenceOnline && client.idle:
+		return PresenceAway
+	case client.status == "":
+		return PresenceOnline
+	}
+	return client.status
+}
+
+// updatePresence applies change under the presence lock and reports whether
+// the state other clients see changed as a result.
+func (client *Client) updatePresence(change func()) bool {
+	client.presenceMu.Lock()
+	defer client.presenceMu.Unlock()
+
+	before := client.visiblePresenceLocked()
+	change()
+	after := client.visiblePresenceLocked()
+	client.Presence = after
+
+	return before != after
+}
+
+// touch records activity from the client, bringing it back from idle.
+func (client *Client) touch() {
+	changed := client.updatePresence(func() {
+		client.lastActivity = time.Now()
+		client.idle = false
+	})
+
+	if changed {
+		client.wsServer.publishPresence(client)
+	}
+}
+
+func (client *Client) touchPong() {
+	client.presenceMu.Lock()
+	defer client.presenceMu.Unlock()
+
+	client.lastPong = time.Now()
+}
+
+func (client *Client) handleSetPresenceMessage(message Message) {
+	if !isSettablePresence(message.Message) {
+		client.logger().Warn("Invalid presence", "action", message.Action, "presence", message.Message)
+		return
+	}
+
+	changed := client.updatePresence(func() {
+		client.status = message.Message
+	})
+
+	if changed {
+		client.wsServer.publishPresence(client)
+	}
+}
+
+func (server *WsServer) presenceUpdate(client *Client) *PresenceUpdateMessage {
+	update := &PresenceUpdateMessage{
+		Action:   PresenceUpdateAction,
+		UserID:   client.ID,
+		Name:     client.Name,
+		Presence: client.visiblePresence(),
+	}
+
+	if update.Presence == PresenceOffline {
+		lastSeen := server.lastSeenAt(client.ID)
+		update.LastSeen = &lastSeen
+	}
+
+	return update
+}
+
+// publishPresence sends the client's current visible presence to everyone
+// through the server loop.
+func (server *WsServer) publishPresence(client *Client) {
+	if client.visiblePresence() == PresenceOffline {
+		server.markSeen(client.ID, time.Now())
+	}
+
+	server.broadcast <- server.presenceUpdate(client).encode()
+}
+
+func (server *WsServer) markSeen(id uuid.UUID, at time.Time) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.lastSeen[id] = at
+}
+
+func (server *WsServer) lastSeenAt(id uuid.UUID) time.Time {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.lastSeen[id]
+}
+
+// RunPresenceMonitor marks clients as away once they have had no activity
+// for idleTimeout, or have stopped answering pings. It never returns.
+func (server *WsServer) RunPresenceMonitor(idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 10)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		server.checkPresence(now, idleTimeout)
+	}
+}
+
+func (server *WsServer) checkPresence(now time.Time, idleTimeout time.Duration) {
+	for _, client := range server.clientsSnapshot() {
+		changed := client.updatePresence(func() {
+			inactive := !client.lastActivity.IsZero() && now.Sub(client.lastActivity) > idleTimeout
+			silent := !client.lastPong.IsZero() && now.Sub(client.lastPong) > pongWait
+			client.idle = client.idle || inactive || silent
+		})
+
+		if changed {
+			server.publishPresence(client)
+		}
+	}
+}
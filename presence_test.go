@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receivePresenceUpdate(t *testing.T, server *WsServer) PresenceUpdateMessage {
+	select {
+	case data := <-server.broadcast:
+		var update PresenceUpdateMessage
+		require.NoError(t, json.Unmarshal(data, &update))
+		return update
+	case <-time.After(time.Second):
+		t.Fatal("Expected a presence update to be broadcast")
+		return PresenceUpdateMessage{}
+	}
+}
+
+func TestClient_visiblePresence(t *testing.T) {
+	client := newClient(nil, nil, "test")
+	assert.Equal(t, PresenceOnline, client.visiblePresence())
+
+	client.idle = true
+	assert.Equal(t, PresenceAway, client.visiblePresence())
+
+	client.status = PresenceDoNotDisturb
+	assert.Equal(t, PresenceDoNotDisturb, client.visiblePresence())
+
+	client.status = PresenceInvisible
+	assert.Equal(t, PresenceOffline, client.visiblePresence())
+}
+
+func TestHandleSetPresenceMessage(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+
+	go client.handleSetPresenceMessage(Message{Action: SetPresenceAction, Message: PresenceDoNotDisturb})
+	update := receivePresenceUpdate(t, server)
+
+	assert.Equal(t, PresenceUpdateAction, update.Action)
+	assert.Equal(t, client.ID, update.UserID)
+	assert.Equal(t, PresenceDoNotDisturb, update.Presence)
+	assert.Nil(t, update.LastSeen)
+	assert.Equal(t, PresenceDoNotDisturb, client.Presence)
+
+	go client.handleSetPresenceMessage(Message{Action: SetPresenceAction, Message: PresenceInvisible})
+	update = receivePresenceUpdate(t, server)
+
+	assert.Equal(t, PresenceOffline, update.Presence)
+	require.NotNil(t, update.LastSeen)
+	assert.WithinDuration(t, time.Now(), *update.LastSeen, time.Second)
+}
+
+func TestHandleSetPresenceMessage_Invalid(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+
+	client.handleSetPresenceMessage(Message{Action: SetPresenceAction, Message: PresenceOffline})
+
+	assert.Equal(t, PresenceOnline, client.visiblePresence())
+}
+
+func TestCheckPresence_IdleAndBack(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	server.addClient(client)
+
+	go server.checkPresence(time.Now().Add(2*time.Minute), time.Minute)
+	assert.Equal(t, PresenceAway, receivePresenceUpdate(t, server).Presence)
+
+	go client.touch()
+	assert.Equal(t, PresenceOnline, receivePresenceUpdate(t, server).Presence)
+}
+
+func TestUnregisterClient_RecordsLastSeen(t *testing.T) {
+	server := NewWebsocketServer()
+	leaving := newClient(nil, server, "leaving")
+	staying := newClient(nil, server, "staying")
+	server.addClient(leaving)
+	server.addClient(staying)
+
+	server.unregisterClient(leaving)
+
+	assert.WithinDuration(t, time.Now(), server.lastSeenAt(leaving.ID), time.Second)
+	require.NotEmpty(t, staying.send)
+	var left ClientEventMessage
+	require.NoError(t, json.Unmarshal(<-staying.send, &left))
+	assert.Equal(t, UserLeftAction, left.Action)
+	assert.Equal(t, leaving.ID, left.Client.ID)
+	require.NotNil(t, left.LastSeen)
+}
+
+func TestOnlineClients_HidesInvisible(t *testing.T) {
+	server := NewWebsocketServer()
+	visible := newClient(nil, server, "visible")
+	invisible := newClient(nil, server, "invisible")
+	invisible.status = PresenceInvisible
+	server.addClient(visible)
+	server.addClient(invisible)
+
+	assert.Equal(t, []*Client{visible}, server.onlineClients(visible))
+	assert.ElementsMatch(t, []*Client{visible, invisible}, server.onlineClients(invisible))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// redisIOTimeout bounds how long a command may take, so a stalled server
+	// cannot hold up the room and server loops that publish.
+	redisIOTimeout = 2 * time.Second
+
+	redisMinReconnectDelay = 100 * time.Millisecond
+	redisMaxReconnectDelay = 5 * time.Second
+)
+
+var (
+	errBrokerClosed       = errors.New("broker is closed")
+	errBrokerDisconnected = errors.New("not connected to the broker")
+)
+
+// RedisBroker is a Broker backed by the PUBLISH and SUBSCRIBE commands of a
+// Redis compatible server, so several chat nodes can share rooms. It uses one
+// connection for publishing and one that stays in subscribe mode. Both are
+// reconnected when they fail, and the subscriptions are then made again.
+type RedisBroker struct {
+	addr    string
+	timeout time.Duration
+
+	pubMu   sync.Mutex
+	pubConn net.Conn
+	pubR    *bufio.Reader
+
+	subMu       sync.Mutex
+	subConn     net.Conn
+	subscribers map[string]map[int]func([]byte)
+	nextID      int
+	closed      bool
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func NewRedisBroker(addr string) (*RedisBroker, error) {
+	pubConn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	subConn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		pubConn.Close()
+		return nil, err
+	}
+
+	broker := &RedisBroker{
+		addr:        addr,
+		timeout:     redisIOTimeout,
+		pubConn:     pubConn,
+		pubR:        bufio.NewReader(pubConn),
+		subConn:     subConn,
+		subscribers: make(map[string]map[int]func([]byte)),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go broker.readSubscriptions(subConn)
+
+	return broker, nil
+}
+
+// Publish sends payload to every subscriber of topic. If the publish
+// connection was lost it is dialled again first.
+func (broker *RedisBroker) Publish(topic string, payload []byte) error {
+	broker.pubMu.Lock()
+	defer broker.pubMu.Unlock()
+
+	if err := broker.dialPublisher(); err != nil {
+		return err
+	}
+
+	reply, err := broker.publish(topic, payload)
+	if err != nil {
+		// The reply may still arrive later and would be read as the answer to
+		// the next command, so the connection cannot be used again.
+		broker.pubConn.Close()
+		broker.pubConn = nil
+		return err
+	}
+	if replyErr, ok := reply.(error); ok {
+		return replyErr
+	}
+
+	return nil
+}
+
+func (broker *RedisBroker) publish(topic string, payload []byte) (interface{}, error) {
+	broker.pubConn.SetDeadline(time.Now().Add(broker.timeout))
+	if err := writeRESPCommand(broker.pubConn, []byte("PUBLISH"), []byte(topic), payload); err != nil {
+		return nil, err
+	}
+	return readRESP(broker.pubR)
+}
+
+// dialPublisher connects the publish connection if it is not connected.
+// pubMu must be held.
+func (broker *RedisBroker) dialPublisher() error {
+	if broker.pubConn != nil {
+		return nil
+	}
+
+	broker.subMu.Lock()
+	closed := broker.closed
+	broker.subMu.Unlock()
+	if closed {
+		return errBrokerClosed
+	}
+
+	conn, err := net.DialTimeout("tcp", broker.addr, redisDialTimeout)
+	if err != nil {
+		return err
+	}
+	broker.pubConn = conn
+	broker.pubR = bufio.NewReader(conn)
+
+	return nil
+}
+
+func (broker *RedisBroker) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	broker.subMu.Lock()
+	defer broker.subMu.Unlock()
+
+	if broker.closed {
+		return nil, errBrokerClosed
+	}
+
+	if broker.subscribers[topic] == nil {
+		// While disconnected the topic is subscribed to on reconnect.
+		if broker.subConn != nil {
+			if err := broker.writeSubscriber([]byte("SUBSCRIBE"), []byte(topic)); err != nil {
+				return nil, err
+			}
+		}
+		broker.subscribers[topic] = make(map[int]func([]byte))
+	}
+
+	id := broker.nextID
+	broker.nextID++
+	broker.subscribers[topic][id] = handler
+
+	return func() {
+		broker.subMu.Lock()
+		defer broker.subMu.Unlock()
+
+		delete(broker.subscribers[topic], id)
+		if len(broker.subscribers[topic]) == 0 {
+			delete(broker.subscribers, topic)
+			if !broker.closed && broker.subConn != nil {
+				broker.writeSubscriber([]byte("UNSUBSCRIBE"), []byte(topic))
+			}
+		}
+	}, nil
+}
+
+// writeSubscriber sends a command on the subscribe connection. subMu must be
+// held.
+func (broker *RedisBroker) writeSubscriber(args ...[]byte) error {
+	broker.subConn.SetWriteDeadline(time.Now().Add(broker.timeout))
+	return writeRESPCommand(broker.subConn, args...)
+}
+
+// Check reports whether the broker is connected. It fails while the
+// subscribe connection is being re-established, and dials the publish
+// connection if it was lost.
+func (broker *RedisBroker) Check() error {
+	broker.subMu.Lock()
+	closed, connected := broker.closed, broker.subConn != nil
+	broker.subMu.Unlock()
+
+	switch {
+	case closed:
+		return errBrokerClosed
+	case !connected:
+		return errBrokerDisconnected
+	}
+
+	broker.pubMu.Lock()
+	defer broker.pubMu.Unlock()
+
+	return broker.dialPublisher()
+}
+
+func (broker *RedisBroker) Close() error {
+	broker.subMu.Lock()
+	broker.closed = true
+	close(broker.closing)
+	var subErr error
+	if broker.subConn != nil {
+		subErr = broker.subConn.Close()
+	}
+	broker.subMu.Unlock()
+
+	broker.pubMu.Lock()
+	var pubErr error
+	if broker.pubConn != nil {
+		pubErr = broker.pubConn.Close()
+	}
+	broker.pubMu.Unlock()
+
+	<-broker.done
+
+	return errors.Join(pubErr, subErr)
+}
+
+// readSubscriptions hands the messages pushed on the subscribe connection
+// to the handlers of their topic, reconnecting whenever the connection is
+// lost until the broker is closed.
+func (broker *RedisBroker) readSubscriptions(conn net.Conn) {
+	defer close(broker.done)
+
+	for {
+		err := broker.receive(conn)
+
+		broker.subMu.Lock()
+		closed := broker.closed
+		if !closed {
+			conn.Close()
+			broker.subConn = nil
+		}
+		broker.subMu.Unlock()
+		if closed {
+			return
+		}
+
+		slog.Error("Lost connection to the broker, reconnecting", "error", err)
+		if conn = broker.reconnect(); conn == nil {
+			return
+		}
+		slog.Info("Reconnected to the broker")
+	}
+}
+
+// receive reads from the subscribe connection until it fails.
+func (broker *RedisBroker) receive(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return err
+		}
+
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		topic, _ := push[1].([]byte)
+		payload, _ := push[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		broker.subMu.Lock()
+		handlers := make([]func([]byte), 0, len(broker.subscribers[string(topic)]))
+		for _, handler := range broker.subscribers[string(topic)] {
+			handlers = append(handlers, handler)
+		}
+		broker.subMu.Unlock()
+
+		for _, handler := range handlers {
+			handler(payload)
+		}
+	}
+}
+
+// reconnect dials the subscribe connection again, backing off between
+// attempts, and subscribes to every topic that still has handlers. It
+// returns nil if the broker is closed first.
+func (broker *RedisBroker) reconnect() net.Conn {
+	delay := redisMinReconnectDelay
+	for {
+		select {
+		case <-broker.closing:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > redisMaxReconnectDelay {
+			delay = redisMaxReconnectDelay
+		}
+
+		conn, err := net.DialTimeout("tcp", broker.addr, redisDialTimeout)
+		if err != nil {
+			slog.Warn("Failed to reconnect to the broker", "error", err)
+			continue
+		}
+
+		broker.subMu.Lock()
+		if broker.closed {
+			broker.subMu.Unlock()
+			conn.Close()
+			return nil
+		}
+		broker.subConn = conn
+		err = broker.resubscribe()
+		if err != nil {
+			broker.subConn = nil
+		}
+		broker.subMu.Unlock()
+
+		if err != nil {
+			conn.Close()
+			slog.Warn("Failed to resubscribe to the broker", "error", err)
+			continue
+		}
+
+		return conn
+	}
+}
+
+// resubscribe subscribes to every topic that has handlers. subMu must be
+// held.
+func (broker *RedisBroker) resubscribe() error {
+	for topic := range broker.subscribers {
+		if err := broker.writeSubscriber([]byte("SUBSCRIBE"), []byte(topic)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRESPCommand writes a command as a RESP array of bulk strings.
+func writeRESPCommand(w io.Writer, args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRESP reads one RESP value. Simple and bulk strings are returned as
+// []byte, integers as int64, arrays as []interface{} and error replies as
+// error. Null bulk strings and arrays are returned as nil.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed RESP line %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return errors.New(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unknown RESP type %q", kind)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a stand-in for a Redis server that only knows the pub/sub
+// commands the RedisBroker uses.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       map[*fakeRedisConn]bool
+	subscribers map[string]map[*fakeRedisConn]bool
+	// stalled makes the server stop answering PUBLISH.
+	stalled bool
+}
+
+type fakeRedisConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (conn *fakeRedisConn) write(args ...[]byte) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	writeRESPCommand(conn.conn, args...)
+}
+
+func (conn *fakeRedisConn) writeRaw(data string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.conn.Write([]byte(data))
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	fake := &fakeRedis{
+		listener:    listener,
+		conns:       make(map[*fakeRedisConn]bool),
+		subscribers: make(map[string]map[*fakeRedisConn]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(&fakeRedisConn{conn: conn})
+		}
+	}()
+
+	return fake
+}
+
+func (fake *fakeRedis) addr() string {
+	return fake.listener.Addr().String()
+}
+
+// dropConnections closes every connection the fake has accepted.
+func (fake *fakeRedis) dropConnections() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for conn := range fake.conns {
+		conn.conn.Close()
+	}
+}
+
+func (fake *fakeRedis) serve(conn *fakeRedisConn) {
+	fake.mu.Lock()
+	fake.conns[conn] = true
+	fake.mu.Unlock()
+
+	defer func() {
+		fake.mu.Lock()
+		delete(fake.conns, conn)
+		for _, subscribers := range fake.subscribers {
+			delete(subscribers, conn)
+		}
+		fake.mu.Unlock()
+		conn.conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn.conn)
+	for {
+		value, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, ok := value.([]interface{})
+		if !ok || len(args) == 0 {
+			conn.writeRaw("-ERR expected a command\r\n")
+			continue
+		}
+
+		command, _ := args[0].([]byte)
+		switch strings.ToUpper(string(command)) {
+		case "PUBLISH":
+			topic, _ := args[1].([]byte)
+			payload, _ := args[2].([]byte)
+			fake.mu.Lock()
+			if fake.stalled {
+				fake.mu.Unlock()
+				continue
+			}
+			receivers := 0
+			for subscriber := range fake.subscribers[string(topic)] {
+				subscriber.write([]byte("message"), topic, payload)
+				receivers++
+			}
+			fake.mu.Unlock()
+			conn.writeRaw(":" + strconv.Itoa(receivers) + "\r\n")
+
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			topic, _ := args[1].([]byte)
+			fake.mu.Lock()
+			if strings.EqualFold(string(command), "SUBSCRIBE") {
+				if fake.subscribers[string(topic)] == nil {
+					fake.subscribers[string(topic)] = make(map[*fakeRedisConn]bool)
+				}
+				fake.subscribers[string(topic)][conn] = true
+			} else {
+				delete(fake.subscribers[string(topic)], conn)
+			}
+			fake.mu.Unlock()
+			conn.write(bytes.ToLower(command), topic, []byte("1"))
+
+		default:
+			conn.writeRaw("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("+OK\r\n-ERR bad\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*2\r\n$3\r\nfoo\r\n:1\r\n"))
+
+	value, err := readRESP(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("OK"), value)
+
+	value, err = readRESP(reader)
+	require.NoError(t, err)
+	assert.EqualError(t, value.(error), "ERR bad")
+
+	value, err = readRESP(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+
+	value, err = readRESP(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("he\r\no"), value)
+
+	value, err = readRESP(reader)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	value, err = readRESP(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte("foo"), int64(1)}, value)
+}
+
+func TestRedisBroker_PublishSubscribe(t *testing.T) {
+	fake := newFakeRedis(t)
+
+	subscriber, err := NewRedisBroker(fake.addr())
+	require.NoError(t, err)
+	defer subscriber.Close()
+	publisher, err := NewRedisBroker(fake.addr())
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	received := make(chan []byte, 16)
+	unsubscribe, err := subscriber.Subscribe("topic", func(payload []byte) {
+		received <- payload
+	})
+	require.NoError(t, err)
+
+	// SUBSCRIBE is sent without waiting for the reply, so publish until the
+	// subscription is in place.
+	require.Eventually(t, func() bool {
+		assert.NoError(t, publisher.Publish("topic", []byte("hello\r\nworld")))
+		select {
+		case payload := <-received:
+			return assert.Equal(t, []byte("hello\r\nworld"), payload)
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, time.Millisecond)
+
+	unsubscribe()
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.subscribers["topic"]) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestRedisBroker_SharesRoomsBetweenNodes(t *testing.T) {
+	fake := newFakeRedis(t)
+
+	newNode := func() *WsServer {
+		broker, err := NewRedisBroker(fake.addr())
+		require.NoError(t, err)
+		t.Cleanup(func() { broker.Close() })
+
+		server, err := NewWebsocketServerWithBroker(broker)
+		require.NoError(t, err)
+		return server
+	}
+	nodeA := newNode()
+	nodeB := newNode()
+
+	roomA := nodeA.createRoom("general", false, nil)
+	roomB := nodeB.createRoom("general", false, nil)
+	require.Equal(t, roomA.ID, roomB.ID)
+
+	client := newClient(nil, nodeA, "test")
+	nodeA.addClient(client)
+	roomA.registerClientInRoom(client)
+
+	received := func(expected string) func() bool {
+		return func() bool {
+			select {
+			case payload := <-client.send:
+				return string(payload) == expected
+			default:
+				return false
+			}
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		roomB.publish([]byte("room message"))
+		return received("room message")()
+	}, time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		nodeB.publishToClients(nil, []byte("announcement"))
+		return received("announcement")()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisBroker_PublishTimesOut(t *testing.T) {
+	fake := newFakeRedis(t)
+	broker, err := NewRedisBroker(fake.addr())
+	require.NoError(t, err)
+	defer broker.Close()
+	broker.timeout = 50 * time.Millisecond
+
+	fake.mu.Lock()
+	fake.stalled = true
+	fake.mu.Unlock()
+
+	started := time.Now()
+	assert.Error(t, broker.Publish("topic", []byte("hello")))
+	assert.Less(t, time.Since(started), time.Second)
+
+	fake.mu.Lock()
+	fake.stalled = false
+	fake.mu.Unlock()
+
+	assert.NoError(t, broker.Publish("topic", []byte("hello")), "Expected the publish connection to be dialled again")
+}
+
+func TestRedisBroker_Reconnects(t *testing.T) {
+	fake := newFakeRedis(t)
+	broker, err := NewRedisBroker(fake.addr())
+	require.NoError(t, err)
+	defer broker.Close()
+
+	received := make(chan []byte, 16)
+	_, err = broker.Subscribe("topic", func(payload []byte) {
+		received <- payload
+	})
+	require.NoError(t, err)
+
+	delivered := func() bool {
+		broker.Publish("topic", []byte("hello"))
+		select {
+		case <-received:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}
+	require.Eventually(t, delivered, time.Second, time.Millisecond)
+	require.NoError(t, broker.Check())
+
+	fake.dropConnections()
+	require.Eventually(t, func() bool {
+		return broker.Check() != nil
+	}, time.Second, time.Millisecond, "Expected the broker to report the lost connection")
+
+	require.Eventually(t, delivered, 5*time.Second, 10*time.Millisecond, "Expected the subscription to be made again")
+	assert.NoError(t, broker.Check())
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxReportReasonLength = 1000
+	// reportContextSize is how many messages before and after the reported
+	// one are kept with a report.
+	reportContextSize = 5
+)
+
+const (
+	ReportStatusOpen     = "open"
+	ReportStatusResolved = "resolved"
+)
+
+// What a moderator can do when resolving a report.
+const (
+	ReportActionDismiss       = "dismiss"
+	ReportActionDeleteMessage = "delete-message"
+	ReportActionKick          = "kick"
+	ReportActionBan           = "ban"
+)
+
+var (
+	errReportReasonRequired = errors.New("a reason is required")
+	errReportReasonTooLong  = errors.New("reason is too long")
+	errReportedNotFound     = errors.New("message not found")
+	errReportOwnMessage     = errors.New("you cannot report your own message")
+	errAlreadyReported      = errors.New("you already reported this message")
+	errNotRoomMember        = errors.New("you are not a member of this room")
+	errBannedFromRoom       = errors.New("you are banned from this room")
+	errReportNotFound       = errors.New("report not found")
+	errRoomNotFound         = errors.New("room not found")
+	errReportResolved       = errors.New("report is already resolved")
+	errInvalidReportAction  = errors.New("action must be dismiss, delete-message, kick or ban")
+)
+
+func isReportAction(action string) bool {
+	switch action {
+	case ReportActionDismiss, ReportActionDeleteMessage, ReportActionKick, ReportActionBan:
+		return true
+	}
+	return false
+}
+
+// ReportRequest is the payload of the report-message action.
+type ReportRequest struct {
+	MessageID uuid.UUID `json:"messageId"`
+	Reason    string    `json:"reason"`
+}
+
+// Report is a message a member flagged for moderators, with the messages
+// around it as they were when it was reported.
+type Report struct {
+	ID         uuid.UUID         `json:"id"`
+	RoomID     uuid.UUID         `json:"roomId"`
+	RoomName   string            `json:"roomName"`
+	Message    MessageView       `json:"message"`
+	Context    []MessageView     `json:"context"`
+	ReporterID uuid.UUID         `json:"reporterId"`
+	Reason     string            `json:"reason"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Status     string            `json:"status"`
+	Resolution *ReportResolution `json:"resolution,omitempty"`
+}
+
+type ReportResolution struct {
+	Action     string    `json:"action"`
+	Moderator  string    `json:"moderator"`
+	Note       string    `json:"note,omitempty"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+}
+
+// AuditEntry records a moderation action taken on a report.
+type AuditEntry struct {
+	ReportID  uuid.UUID  `json:"reportId"`
+	Action    string     `json:"action"`
+	Moderator string     `json:"moderator"`
+	Note      string     `json:"note,omitempty"`
+	RoomID    uuid.UUID  `json:"roomId"`
+	MessageID uuid.UUID  `json:"messageId"`
+	UserID    *uuid.UUID `json:"userId,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// ReportStore is the moderation queue. It keeps every report, open or
+// resolved, and the audit trail of what moderators did about them.
+type ReportStore struct {
+	mu      sync.Mutex
+	reports []*Report
+	audit   []AuditEntry
+}
+
+func NewReportStore() *ReportStore {
+	return &ReportStore{
+		reports: make([]*Report, 0),
+		audit:   make([]AuditEntry, 0),
+	}
+}
+
+// add queues report, unless its reporter already has an open report for the
+// same message.
+func (store *ReportStore) add(report *Report) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, existing := range store.reports {
+		if existing.Status == ReportStatusOpen && existing.ReporterID == report.ReporterID && existing.Message.ID == report.Message.ID {
+			return errAlreadyReported
+		}
+	}
+
+	store.reports = append(store.reports, report)
+	return nil
+}
+
+// list returns copies of the reports with the given status, or of every
+// report if status is empty, oldest first.
+func (store *ReportStore) list(status string) []Report {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	reports := make([]Report, 0, len(store.reports))
+	for _, report := range store.reports {
+		if status == "" || report.Status == status {
+			reports = append(reports, *report)
+		}
+	}
+
+	return reports
+}
+
+func (store *ReportStore) get(id uuid.UUID) (Report, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, report := range store.reports {
+		if report.ID == id {
+			return *report, true
+		}
+	}
+	return Report{}, false
+}
+
+// resolve marks an open report as resolved and records it in the audit
+// trail.
+func (store *ReportStore) resolve(id uuid.UUID, resolution ReportResolution) (Report, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, report := range store.reports {
+		if report.ID != id {
+			continue
+		}
+		if report.Status == ReportStatusResolved {
+			return Report{}, errReportResolved
+		}
+
+		report.Status = ReportStatusResolved
+		report.Resolution = &resolution
+
+		entry := AuditEntry{
+			ReportID:  report.ID,
+			Action:    resolution.Action,
+			Moderator: resolution.Moderator,
+			Note:      resolution.Note,
+			RoomID:    report.RoomID,
+			MessageID: report.Message.ID,
+			CreatedAt: resolution.ResolvedAt,
+		}
+		if report.Message.Sender != nil {
+			entry.UserID = &report.Message.Sender.ID
+		}
+		store.audit = append(store.audit, entry)
+
+		return *report, nil
+	}
+
+	return Report{}, errReportNotFound
+}
+
+func (store *ReportStore) auditTrail() []AuditEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return append([]AuditEntry(nil), store.audit...)
+}
+
+// messageContext returns the message with the given ID from the room's
+// history together with up to reportContextSize messages on either side.
+func (room *Room) messageContext(id uuid.UUID) (*Message, []Message) {
+	history := room.history()
+	for i := range history {
+		if history[i].ID != id {
+			continue
+		}
+
+		start := i - reportContextSize
+		if start < 0 {
+			start = 0
+		}
+		end := i + reportContextSize + 1
+		if end > len(history) {
+			end = len(history)
+		}
+
+		return &history[i], history[start:end]
+	}
+
+	return nil, nil
+}
+
+// removeMessage deletes a message from the room's history and returns it.
+func (room *Room) removeMessage(id uuid.UUID) (Message, bool) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for i, message := range room.Messages {
+		if message.ID == id {
+			room.Messages = append(room.Messages[:i], room.Messages[i+1:]...)
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+func (room *Room) ban(id uuid.UUID) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.banned == nil {
+		room.banned = make(map[uuid.UUID]bool)
+	}
+	room.banned[id] = true
+}
+
+func (room *Room) isBanned(id uuid.UUID) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	return room.banned[id]
+}
+
+// reportMessage queues a report of a message in room by reporter.
+func (server *WsServer) reportMessage(room *Room, reporter *Client, request ReportRequest) (*Report, error) {
+	reason := strings.TrimSpace(request.Reason)
+	switch {
+	case reason == "":
+		return nil, errReportReasonRequired
+	case utf8.RuneCountInString(reason) > maxReportReasonLength:
+		return nil, errReportReasonTooLong
+	case !room.hasClient(reporter):
+		return nil, errNotRoomMember
+	}
+
+	message, context := room.messageContext(request.MessageID)
+	if message == nil {
+		return nil, errReportedNotFound
+	}
+	if message.Sender != nil && message.Sender.ID == reporter.ID {
+		return nil, errReportOwnMessage
+	}
+
+	report := &Report{
+		ID:         uuid.New(),
+		RoomID:     room.ID,
+		RoomName:   room.GetName(),
+		Message:    message.view(),
+		Context:    messageViews(context),
+		ReporterID: reporter.ID,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+		Status:     ReportStatusOpen,
+	}
+	if err := server.reports.add(report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// resolveReport resolves an open report and carries out action on the
+// reported message or its sender.
+func (server *WsServer) resolveReport(id uuid.UUID, action, moderator, note string) (Report, error) {
+	if !isReportAction(action) {
+		return Report{}, errInvalidReportAction
+	}
+
+	report, ok := server.reports.get(id)
+	if !ok {
+		return Report{}, errReportNotFound
+	}
+	if report.Status == ReportStatusResolved {
+		return Report{}, errReportResolved
+	}
+
+	room := server.findRoomByID(report.RoomID.String())
+	if room == nil && action != ReportActionDismiss {
+		return Report{}, errRoomNotFound
+	}
+
+	report, err := server.reports.resolve(id, ReportResolution{
+		Action:     action,
+		Moderator:  moderator,
+		Note:       note,
+		ResolvedAt: time.Now(),
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	var senderID uuid.UUID
+	if report.Message.Sender != nil {
+		senderID = report.Message.Sender.ID
+	}
+
+	switch action {
+	case ReportActionDeleteMessage:
+		server.deleteMessage(room, report.Message.ID)
+	case ReportActionBan:
+		room.ban(senderID)
+		server.removeFromRoom(room, senderID)
+	case ReportActionKick:
+		server.removeFromRoom(room, senderID)
+	}
+
+	return report, nil
+}
+
+// deleteMessage removes a message from the room, the search index and
+// unread mentions, and tells the members to remove it.
+func (server *WsServer) deleteMessage(room *Room, id uuid.UUID) {
+	message, ok := room.removeMessage(id)
+	if !ok {
+		return
+	}
+
+	server.search.Remove(id)
+	server.mentions.removeMessage(id)
+
+	candidates := make(map[string]bool)
+	for _, blobID := range message.blobIDs() {
+		candidates[blobID] = true
+	}
+	server.deleteUnreferencedMedia(candidates)
+
+	room.send(&Message{
+		ID:        id,
+		Action:    MessageDeletedAction,
+		Target:    room,
+		CreatedAt: time.Now(),
+	})
+}
+
+// removeFromRoom takes the user with the given ID out of room and tells
+// them if they are connected. A seat held for them while they are offline is
+// given up as well.
+func (server *WsServer) removeFromRoom(room *Room, id uuid.UUID) {
+	room.releaseSeat(id)
+
+	client := server.clientByID(id)
+	if client == nil || !client.isInRoom(room) {
+		return
+	}
+
+	client.removeRoom(room)
+	client.stopTyping(room.ID)
+	room.leave(client)
+
+	removedMsg := &RoomEventMessage{
+		Action: RemovedFromRoomAction,
+		RoomID: room.ID,
+		Name:   room.GetName(),
+	}
+	client.enqueue(removedMsg.encode())
+}
+
+func (client *Client) handleReportMessage(message Message) {
+	if message.Report == nil || message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	report, err := client.wsServer.reportMessage(room, client, *message.Report)
+	if err != nil {
+		client.sendError(message.Action, room, err)
+		return
+	}
+
+	client.logger().Info("Message reported", roomAttr(room), "reportId", report.ID, "messageId", report.Message.ID)
+
+	reportedMsg := &MessageReportedMessage{
+		Action:    MessageReportedAction,
+		ReportID:  report.ID,
+		MessageID: report.Message.ID,
+	}
+	client.enqueue(reportedMsg.encode())
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reportingRoom sets up a room with a reporter and a sender who are both
+// members, and the given number of messages from the sender.
+func reportingRoom(t *testing.T, messages int) (*WsServer, *Room, *Client, *Client) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "reporter", "sender")
+	reporter, sender := clients[0], clients[1]
+	room := server.createRoom("general", false, nil)
+	for _, client := range clients {
+		client.addRoom(room)
+		require.True(t, room.join(client))
+	}
+	requireMembers(t, room, 2)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	for i := 0; i < messages; i++ {
+		room.storeMessage(Message{ID: uuid.New(), Action: SendMessageAction, Message: strconv.Itoa(i), Sender: sender, Target: room})
+	}
+
+	return server, room, reporter, sender
+}
+
+func reportJSON(room *Room, messageID uuid.UUID, reason string) []byte {
+	return []byte(`{"action":"report-message","target":{"id":"` + room.GetId() + `"},"report":{"messageId":"` + messageID.String() + `","reason":"` + reason + `"}}`)
+}
+
+func TestReportMessage(t *testing.T) {
+	server, room, reporter, sender := reportingRoom(t, 12)
+	reported := room.history()[2]
+
+	reporter.handleNewMessage(reportJSON(room, reported.ID, "  harassment  "))
+
+	var reportedMsg MessageReportedMessage
+	require.NoError(t, json.Unmarshal(<-reporter.send, &reportedMsg))
+	assert.Equal(t, MessageReportedAction, reportedMsg.Action)
+	assert.Equal(t, reported.ID, reportedMsg.MessageID)
+
+	reports := server.reports.list(ReportStatusOpen)
+	require.Len(t, reports, 1)
+	report := reports[0]
+	assert.Equal(t, reportedMsg.ReportID, report.ID)
+	assert.Equal(t, "harassment", report.Reason)
+	assert.Equal(t, reporter.ID, report.ReporterID)
+	assert.Equal(t, sender.ID, report.Message.Sender.ID)
+	require.Len(t, report.Context, 8, "Expected the two messages before and five after")
+	assert.Equal(t, "0", report.Context[0].Message)
+	assert.Equal(t, "7", report.Context[7].Message)
+
+	for _, test := range []struct {
+		client *Client
+		data   []byte
+		err    error
+	}{
+		{reporter, reportJSON(room, reported.ID, "again"), errAlreadyReported},
+		{reporter, reportJSON(room, uuid.New(), "spam"), errReportedNotFound},
+		{reporter, reportJSON(room, reported.ID, " "), errReportReasonRequired},
+		{sender, reportJSON(room, reported.ID, "mine"), errReportOwnMessage},
+	} {
+		test.client.handleNewMessage(test.data)
+
+		var rejected ErrorMessage
+		require.NoError(t, json.Unmarshal(<-test.client.send, &rejected))
+		assert.Equal(t, ErrorAction, rejected.Action)
+		assert.Equal(t, ReportMessageAction, rejected.RequestAction)
+		assert.Equal(t, test.err.Error(), rejected.Error)
+	}
+
+	outsider := newClient(nil, server, "outsider")
+	server.addClient(outsider)
+	outsider.handleNewMessage(reportJSON(room, reported.ID, "spam"))
+	var rejected ErrorMessage
+	require.NoError(t, json.Unmarshal(<-outsider.send, &rejected))
+	assert.Equal(t, errNotRoomMember.Error(), rejected.Error)
+
+	assert.Len(t, server.reports.list(""), 1)
+}
+
+func TestResolveReport_DeleteMessage(t *testing.T) {
+	server, room, reporter, sender := reportingRoom(t, 3)
+	reported := room.history()[1]
+	report, err := server.reportMessage(room, reporter, ReportRequest{MessageID: reported.ID, Reason: "spam"})
+	require.NoError(t, err)
+
+	_, err = server.resolveReport(report.ID, "shout", "mod", "")
+	assert.ErrorIs(t, err, errInvalidReportAction)
+	_, err = server.resolveReport(uuid.New(), ReportActionDismiss, "mod", "")
+	assert.ErrorIs(t, err, errReportNotFound)
+
+	resolved, err := server.resolveReport(report.ID, ReportActionDeleteMessage, "mod", "clear spam")
+	require.NoError(t, err)
+	assert.Equal(t, ReportStatusResolved, resolved.Status)
+	require.NotNil(t, resolved.Resolution)
+	assert.Equal(t, "mod", resolved.Resolution.Moderator)
+
+	var deleted MessageView
+	require.NoError(t, json.Unmarshal(<-reporter.send, &deleted))
+	assert.Equal(t, MessageDeletedAction, deleted.Action)
+	assert.Equal(t, reported.ID, deleted.ID)
+	assert.Len(t, room.history(), 2)
+	assert.True(t, sender.isInRoom(room))
+
+	_, err = server.resolveReport(report.ID, ReportActionDismiss, "mod", "")
+	assert.ErrorIs(t, err, errReportResolved)
+
+	audit := server.reports.auditTrail()
+	require.Len(t, audit, 1)
+	assert.Equal(t, ReportActionDeleteMessage, audit[0].Action)
+	assert.Equal(t, "clear spam", audit[0].Note)
+	assert.Equal(t, reported.ID, audit[0].MessageID)
+	require.NotNil(t, audit[0].UserID)
+	assert.Equal(t, sender.ID, *audit[0].UserID)
+}
+
+func TestResolveReport_Ban(t *testing.T) {
+	server, room, reporter, sender := reportingRoom(t, 1)
+	report, err := server.reportMessage(room, reporter, ReportRequest{MessageID: room.history()[0].ID, Reason: "abuse"})
+	require.NoError(t, err)
+
+	_, err = server.resolveReport(report.ID, ReportActionBan, "mod", "")
+	require.NoError(t, err)
+
+	var removed RoomEventMessage
+	require.NoError(t, json.Unmarshal(<-sender.send, &removed))
+	assert.Equal(t, RemovedFromRoomAction, removed.Action)
+	assert.Equal(t, room.ID, removed.RoomID)
+	assert.False(t, sender.isInRoom(room))
+	requireMembers(t, room, 1)
+
+	sender.joinRoom("general", sender, false)
+	assert.False(t, sender.isInRoom(room), "Expected banned users not to rejoin")
+
+	sender.handleNewMessage([]byte(`{"action":"send-message","message":"back","target":{"id":"` + room.GetId() + `"}}`))
+	var rejected ErrorMessage
+	require.NoError(t, json.Unmarshal(<-sender.send, &rejected))
+	assert.Equal(t, errBannedFromRoom.Error(), rejected.Error)
+	assert.Len(t, room.history(), 1)
+}
+
+func TestResolveReport_Kick(t *testing.T) {
+	server, room, reporter, sender := reportingRoom(t, 1)
+	report, err := server.reportMessage(room, reporter, ReportRequest{MessageID: room.history()[0].ID, Reason: "rude"})
+	require.NoError(t, err)
+
+	_, err = server.resolveReport(report.ID, ReportActionKick, "mod", "")
+	require.NoError(t, err)
+	assert.False(t, sender.isInRoom(room))
+
+	sender.joinRoom("general", sender, false)
+	assert.True(t, sender.isInRoom(room), "Expected kicked users to be able to rejoin")
+}
+
+func TestResolveReport_OfflineSender(t *testing.T) {
+	for _, action := range []string{ReportActionKick, ReportActionBan} {
+		server, room, reporter, sender := reportingRoom(t, 1)
+		room.keepSeat(sender)
+		server.unregisterClient(sender)
+		require.True(t, room.hasClientID(sender.ID))
+
+		report, err := server.reportMessage(room, reporter, ReportRequest{MessageID: room.history()[0].ID, Reason: "abuse"})
+		require.NoError(t, err)
+		_, err = server.resolveReport(report.ID, action, "mod", "")
+		require.NoError(t, err)
+
+		assert.False(t, room.hasClientID(sender.ID), "Expected %s to take away the seat of an offline sender", action)
+
+		returning := newClient(nil, server, "sender")
+		returning.ID = sender.ID
+		server.restoreSeats(returning)
+		assert.False(t, returning.isInRoom(room), action)
+	}
+}
+
+func TestRestoreSeats_SkipsBannedRooms(t *testing.T) {
+	server, room, _, sender := reportingRoom(t, 0)
+	room.keepSeat(sender)
+	server.unregisterClient(sender)
+	room.ban(sender.ID)
+
+	returning := newClient(nil, server, "sender")
+	returning.ID = sender.ID
+	server.restoreSeats(returning)
+
+	assert.False(t, returning.isInRoom(room))
+	assert.False(t, room.hasClientID(sender.ID))
+}
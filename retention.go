@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// What happens to the history of a deleted room. Messages are always
+// removed from the room, the search index and unread mentions.
+const (
+	// DeletedHistoryPurge also deletes uploaded media that no remaining
+	// message refers to.
+	DeletedHistoryPurge = "purge"
+	// DeletedHistoryKeepMedia keeps uploaded media, so links to it that were
+	// shared elsewhere keep working.
+	DeletedHistoryKeepMedia = "keep-media"
+)
+
+func isDeletedHistoryPolicy(policy string) bool {
+	return policy == DeletedHistoryPurge || policy == DeletedHistoryKeepMedia
+}
+
+// maxRetentionAge is the longest MaxAgeSeconds a room can be given. Longer
+// ages would overflow a time.Duration.
+const maxRetentionAge = 100 * 365 * 24 * time.Hour
+
+// RetentionPolicy limits how much history a room keeps. A zero value for
+// either limit means that limit is not enforced.
+type RetentionPolicy struct {
+	MaxAgeSeconds int64 `json:"maxAgeSeconds,omitempty"`
+	MaxMessages   int   `json:"maxMessages,omitempty"`
+}
+
+func (policy RetentionPolicy) isZero() bool {
+	return policy.MaxAgeSeconds <= 0 && policy.MaxMessages <= 0
+}
+
+func (policy RetentionPolicy) maxAge() time.Duration {
+	if policy.MaxAgeSeconds > int64(maxRetentionAge/time.Second) {
+		return maxRetentionAge
+	}
+	return time.Duration(policy.MaxAgeSeconds) * time.Second
+}
+
+// expired returns how many messages from the start of messages, which are
+// in the order they were stored, fall outside the policy at now.
+func (policy RetentionPolicy) expired(messages []Message, now time.Time) int {
+	cut := 0
+	if policy.MaxMessages > 0 && len(messages) > policy.MaxMessages {
+		cut = len(messages) - policy.MaxMessages
+	}
+
+	if policy.MaxAgeSeconds > 0 {
+		cutoff := now.Add(-policy.maxAge())
+		for cut < len(messages) && messages[cut].CreatedAt.Before(cutoff) {
+			cut++
+		}
+	}
+
+	return cut
+}
+
+func (message *Message) blobIDs() []string {
+	ids := make([]string, 0, len(message.Attachments)*2+1)
+	if message.AttachmentID != "" {
+		ids = append(ids, message.AttachmentID)
+	}
+	for _, attachment := range message.Attachments {
+		ids = append(ids, attachment.BlobID)
+		if attachment.ThumbnailID != "" {
+			ids = append(ids, attachment.ThumbnailID)
+		}
+	}
+
+	return ids
+}
+
+// RunJanitor prunes room history according to each room's retention policy
+// and deletes idle ephemeral rooms every interval. It never returns.
+func (server *WsServer) RunJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		server.pruneMessages(now)
+		server.deleteIdleRooms(now)
+	}
+}
+
+// pruneMessages drops expired messages from every room and deletes media
+// blobs that are no longer referenced by any remaining message.
+func (server *WsServer) pruneMessages(now time.Time) int {
+	candidates := make(map[string]bool)
+	pruned := 0
+	for _, room := range server.roomsSnapshot() {
+		policy := room.retentionPolicy()
+		if policy.isZero() {
+			policy = server.defaultRetention
+		}
+
+		for _, message := range room.pruneMessages(policy, now) {
+			server.search.Remove(message.ID)
+			for _, id := range message.blobIDs() {
+				candidates[id] = true
+			}
+			pruned++
+		}
+	}
+
+	deleted := server.deleteUnreferencedMedia(candidates)
+
+	if pruned > 0 {
+		slog.Info("Pruned expired messages", "messages", pruned, "mediaBlobs", deleted)
+	}
+
+	return pruned
+}
+
+// discardRoomHistory removes the history of a deleted room according to the
+// server's deleted history policy.
+func (server *WsServer) discardRoomHistory(room *Room) {
+	messages := room.takeMessages()
+	server.search.RemoveRoom(room.ID)
+	server.mentions.removeRoom(room.ID)
+
+	if server.deletedHistory == DeletedHistoryKeepMedia {
+		return
+	}
+
+	candidates := make(map[string]bool)
+	for _, message := range messages {
+		for _, id := range message.blobIDs() {
+			candidates[id] = true
+		}
+	}
+	server.deleteUnreferencedMedia(candidates)
+}
+
+// deleteUnreferencedMedia deletes the candidate media blobs that no message
+// in any room refers to, and returns how many it deleted.
+func (server *WsServer) deleteUnreferencedMedia(candidates map[string]bool) int {
+	if len(candidates) == 0 || server.media == nil {
+		return 0
+	}
+
+	for _, room := range server.roomsSnapshot() {
+		room.eachMessage(func(message *Message) {
+			for _, id := range message.blobIDs() {
+				delete(candidates, id)
+			}
+		})
+	}
+
+	for id := range candidates {
+		if err := server.media.Delete(id); err != nil {
+			slog.Error("Error deleting unreferenced media", "mediaId", id, "error", err)
+		}
+	}
+
+	return len(candidates)
+}
+
+// deleteIdleRooms deletes the ephemeral rooms that have been empty for
+// longer than the server's ephemeral room TTL.
+func (server *WsServer) deleteIdleRooms(now time.Time) int {
+	if server.ephemeralRoomTTL <= 0 {
+		return 0
+	}
+
+	deleted := 0
+	for _, room := range server.roomsSnapshot() {
+		if room.Ephemeral && room.idleFor(now) >= server.ephemeralRoomTTL {
+			server.deleteRoom(room)
+			slog.Info("Deleted idle room", roomAttr(room))
+			deleted++
+		}
+	}
+
+	if deleted > 0 {
+		server.sendRoomLists()
+	}
+
+	return deleted
+}
+
+func (client *Client) handleSetRetentionMessage(message Message) {
+	if message.Retention == nil || message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	if room.Owner == nil || room.Owner.ID != client.ID {
+		client.logger().Warn("Client is not allowed to change retention", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	policy := *message.Retention
+	if policy.MaxAgeSeconds < 0 || policy.MaxMessages < 0 || policy.MaxAgeSeconds > int64(maxRetentionAge/time.Second) {
+		return
+	}
+
+	room.setRetentionPolicy(policy)
+
+	room.send(&Message{
+		Action:    RetentionUpdatedAction,
+		Target:    room,
+		Sender:    client,
+		Retention: &policy,
+		Timestamp: message.Timestamp,
+		CreatedAt: message.CreatedAt,
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func messagesAt(times ...time.Time) []Message {
+	messages := make([]Message, 0, len(times))
+	for _, createdAt := range times {
+		messages = append(messages, Message{CreatedAt: createdAt})
+	}
+	return messages
+}
+
+func TestRetentionPolicy_expired(t *testing.T) {
+	now := time.Now()
+	messages := messagesAt(now.Add(-72*time.Hour), now.Add(-48*time.Hour), now.Add(-time.Hour), now)
+
+	assert.Equal(t, 0, RetentionPolicy{}.expired(messages, now))
+	assert.Equal(t, 1, RetentionPolicy{MaxMessages: 3}.expired(messages, now))
+	assert.Equal(t, 2, RetentionPolicy{MaxAgeSeconds: 24 * 60 * 60}.expired(messages, now))
+	assert.Equal(t, 3, RetentionPolicy{MaxAgeSeconds: 24 * 60 * 60, MaxMessages: 1}.expired(messages, now))
+	assert.Equal(t, 0, RetentionPolicy{MaxAgeSeconds: 1e10}.expired(messages, now), "Expected huge ages not to overflow")
+}
+
+func TestSetRetention_MaxAgeTooLong(t *testing.T) {
+	server := NewWebsocketServer()
+	owner := newClient(nil, server, "owner")
+	server.addClient(owner)
+	room := server.createRoom("general", false, owner)
+
+	owner.handleNewMessage([]byte(`{"action":"set-retention","target":{"id":"` + room.GetId() + `"},"retention":{"maxAgeSeconds":10000000000}}`))
+	assert.Equal(t, RetentionPolicy{}, room.retentionPolicy())
+
+	owner.handleNewMessage([]byte(`{"action":"set-retention","target":{"id":"` + room.GetId() + `"},"retention":{"maxAgeSeconds":86400}}`))
+	assert.Equal(t, RetentionPolicy{MaxAgeSeconds: 86400}, room.retentionPolicy())
+}
+
+func TestRoom_pruneMessages(t *testing.T) {
+	now := time.Now()
+	room := NewRoom("TestRoom", false, nil)
+	for _, message := range messagesAt(now.Add(-time.Hour), now.Add(-time.Minute), now) {
+		room.storeMessage(message)
+	}
+
+	pruned := room.pruneMessages(RetentionPolicy{MaxMessages: 1}, now)
+
+	assert.Len(t, pruned, 2)
+	assert.Len(t, room.Messages, 1)
+	assert.Equal(t, now, room.Messages[0].CreatedAt)
+}
+
+func TestPruneMessages_DeletesUnreferencedMedia(t *testing.T) {
+	now := time.Now()
+	server := NewWebsocketServer()
+	server.media = newTestMediaStore(t, 1024)
+
+	expired, err := server.media.Save(strings.NewReader("expired"), "")
+	require.NoError(t, err)
+	shared, err := server.media.Save(strings.NewReader("shared"), "")
+	require.NoError(t, err)
+
+	old := server.createRoom("old", false, nil)
+	old.setRetentionPolicy(RetentionPolicy{MaxAgeSeconds: 60})
+	old.storeMessage(Message{CreatedAt: now.Add(-time.Hour), AttachmentID: expired.ID})
+	old.storeMessage(Message{CreatedAt: now.Add(-time.Hour), Attachments: []Attachment{{BlobID: shared.ID}}})
+
+	current := server.createRoom("current", false, nil)
+	current.storeMessage(Message{CreatedAt: now.Add(-time.Hour), AttachmentID: shared.ID})
+
+	assert.Equal(t, 2, server.pruneMessages(now))
+
+	assert.Empty(t, old.Messages)
+	assert.Len(t, current.Messages, 1)
+	_, err = server.media.Stat(expired.ID)
+	assert.ErrorIs(t, err, errMediaNotFound)
+	_, err = server.media.Stat(shared.ID)
+	assert.NoError(t, err)
+}
+
+func TestPruneMessages_DefaultRetention(t *testing.T) {
+	now := time.Now()
+	server := NewWebsocketServer()
+	server.defaultRetention = RetentionPolicy{MaxMessages: 1}
+
+	room := server.createRoom("room", false, nil)
+	room.storeMessage(Message{CreatedAt: now.Add(-time.Minute)})
+	room.storeMessage(Message{CreatedAt: now})
+
+	assert.Equal(t, 1, server.pruneMessages(now))
+	assert.Len(t, room.Messages, 1)
+}
+
+func TestDeleteRoom_DiscardsHistory(t *testing.T) {
+	for _, policy := range []string{DeletedHistoryPurge, DeletedHistoryKeepMedia} {
+		t.Run(policy, func(t *testing.T) {
+			server := NewWebsocketServer()
+			server.media = newTestMediaStore(t, 1024)
+			server.deletedHistory = policy
+
+			blob, err := server.media.Save(strings.NewReader("attachment"), "")
+			require.NoError(t, err)
+
+			reader := newClient(nil, server, "reader")
+			room := server.createRoom("doomed", false, nil)
+			message := &Message{ID: uuid.New(), Message: "hello", Target: room, AttachmentID: blob.ID, CreatedAt: time.Now()}
+			room.storeMessage(*message)
+			server.search.Add(message, room)
+			server.mentions.add(reader.ID, *message)
+
+			server.deleteRoom(room)
+
+			assert.Empty(t, room.Messages)
+			assert.Empty(t, server.mentions.list(reader.ID))
+			results := server.search.Search(SearchQuery{Query: "hello"}, map[uuid.UUID]bool{room.ID: true})
+			assert.Zero(t, results.Total)
+
+			_, err = server.media.Stat(blob.ID)
+			if policy == DeletedHistoryPurge {
+				assert.ErrorIs(t, err, errMediaNotFound)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteIdleRooms(t *testing.T) {
+	server := NewWebsocketServer()
+	owner := newClient(nil, server, "owner")
+
+	idle := server.createRoom("idle", false, owner)
+	busy := server.createRoom("busy", false, owner)
+	busy.registerClientInRoom(owner)
+	kept := server.createRoom("kept", false, nil)
+
+	assert.True(t, idle.Ephemeral)
+	assert.False(t, kept.Ephemeral)
+	assert.Zero(t, server.deleteIdleRooms(time.Now()))
+
+	assert.Equal(t, 1, server.deleteIdleRooms(time.Now().Add(server.ephemeralRoomTTL)))
+	assert.Nil(t, server.findRoomByName("idle"))
+	assert.NotNil(t, server.findRoomByName("busy"))
+	assert.NotNil(t, server.findRoomByName("kept"))
+
+	server.ephemeralRoomTTL = 0
+	busy.unregisterClientInRoom(owner)
+	assert.Zero(t, server.deleteIdleRooms(time.Now().Add(time.Hour)))
+}
@@ -1,9 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"sync"
+	"time"
+
 	"github.com/google/uuid"
 )
 
+// defaultEphemeralRoomTTL is how long an ephemeral room may stay empty
+// before it is deleted.
+const defaultEphemeralRoomTTL = 10 * time.Minute
+
+// Room is a chat room. Name is unique and what rooms are joined by, while
+// DisplayName is only shown. mu guards Name, the details set by update-room,
+// Clients, clients, offline, Messages, Retention, Filters, filters, banned
+// and emptySince; the other fields do not change once the room is created.
 type Room struct {
 	ID         uuid.UUID `json:"id"`
 	Name       string    `json:"name"`
@@ -14,7 +26,30 @@ type Room struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *Message
-	Private    bool `json:"private"`
+	Private    bool            `json:"private"`
+	Retention  RetentionPolicy `json:"retention"`
+	// Ephemeral rooms are deleted once they have been empty for a while.
+	Ephemeral  bool `json:"ephemeral"`
+	mu         sync.Mutex
+	emptySince time.Time
+
+	DisplayName string `json:"displayName"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	AvatarColor string `json:"avatarColor"`
+
+	Filters FilterPolicy `json:"filters"`
+	filters FilterPipeline
+	banned  map[uuid.UUID]bool
+	// offline holds the IDs of private room members who disconnected. They
+	// are put back in the room when they reconnect.
+	offline map[uuid.UUID]bool
+
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	broker      Broker
+	unsubscribe func()
 }
 
 func NewRoom(name string, private bool, owner *Client) *Room {
@@ -29,53 +64,229 @@ func NewRoom(name string, private bool, owner *Client) *Room {
 		broadcast:  make(chan *Message),
 		Private:    private,
 		Clients:    make([]*Client, 0),
+		emptySince: time.Now(),
+		quit:       make(chan struct{}),
 	}
 }
 
 func (room *Room) RunRoom() {
 	for {
 		select {
+		case <-room.quit:
+			room.detachMembers()
+			return
 
 		case client := <-room.register:
-			room.registerClientInRoom(client)
+			if room.registerClientInRoom(client) {
+				room.notifyMemberChange(RoomMemberAddedAction, client)
+			}
+			room.sendMembers(client)
 
 		case client := <-room.unregister:
-			room.unregisterClientInRoom(client)
+			if room.unregisterClientInRoom(client) {
+				room.notifyMemberChange(RoomMemberRemovedAction, client)
+			}
 
 		case message := <-room.broadcast:
-			room.broadcastToClientsInRoom(message.encode())
+			room.publish(message.encode())
 		}
 
 	}
 }
 
-func (room *Room) registerClientInRoom(client *Client) {
-	if _, ok := room.clients[client]; !ok {
-		room.clients[client] = true
-		room.Clients = append(room.Clients, client)
+// stop ends the room's loop, which then detaches every member. It is safe
+// to call more than once.
+func (room *Room) stop() {
+	room.stopOnce.Do(func() {
+		close(room.quit)
+	})
+}
+
+// join hands client to the room's loop, and reports false if the room was
+// deleted in the meantime.
+func (room *Room) join(client *Client) bool {
+	select {
+	case room.register <- client:
+		return true
+	case <-room.quit:
+		return false
+	}
+}
+
+func (room *Room) leave(client *Client) {
+	select {
+	case room.unregister <- client:
+	case <-room.quit:
+	}
+}
+
+// send broadcasts message to the room, unless the room was deleted.
+func (room *Room) send(message *Message) {
+	select {
+	case room.broadcast <- message:
+	case <-room.quit:
+	}
+}
+
+// detachMembers removes every member from the deleted room and tells them
+// it is gone.
+func (room *Room) detachMembers() {
+	room.mu.Lock()
+	members := room.Clients
+	room.clients = make(map[*Client]bool)
+	room.Clients = make([]*Client, 0)
+	room.offline = nil
+	room.mu.Unlock()
+
+	deletedMsg := &RoomEventMessage{
+		Action: RoomDeletedAction,
+		RoomID: room.ID,
+		Name:   room.GetName(),
+	}
+	message := deletedMsg.encode()
+
+	for _, member := range members {
+		member.removeRoom(room)
+		member.stopTyping(room.ID)
+		member.enqueue(message)
+	}
+}
+
+// idleFor returns how long the room has been without members. Members who
+// are offline still count.
+func (room *Room) idleFor(now time.Time) time.Duration {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if len(room.clients) > 0 || len(room.offline) > 0 || room.emptySince.IsZero() {
+		return 0
 	}
+
+	return now.Sub(room.emptySince)
 }
 
-func (room *Room) unregisterClientInRoom(client *Client) {
+func (room *Room) registerClientInRoom(client *Client) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
 
 	if _, ok := room.clients[client]; ok {
-		delete(room.clients, client)
+		return false
+	}
 
-		for i, existingClient := range room.Clients {
-			if existingClient.ID == client.ID {
-				room.Clients = append(room.Clients[:i], room.Clients[i+1:]...)
-				break
-			}
+	room.clients[client] = true
+	room.Clients = append(room.Clients, client)
+	room.emptySince = time.Time{}
+	return true
+}
+
+func (room *Room) unregisterClientInRoom(client *Client) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if _, ok := room.clients[client]; !ok {
+		return false
+	}
+
+	delete(room.clients, client)
+
+	for i, existingClient := range room.Clients {
+		if existingClient.ID == client.ID {
+			room.Clients = append(room.Clients[:i], room.Clients[i+1:]...)
+			break
 		}
 	}
+	if len(room.clients) == 0 {
+		room.emptySince = time.Now()
+	}
+
+	return true
+}
+
+// keepSeat takes a disconnecting client out of the room without telling the
+// other members, and remembers its ID so it can be put back by takeSeat.
+func (room *Room) keepSeat(client *Client) {
+	if room.unregisterClientInRoom(client) {
+		room.holdSeat(client.ID)
+	}
+}
+
+// holdSeat makes the user with the given ID an offline member of the room.
+func (room *Room) holdSeat(id uuid.UUID) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.offline == nil {
+		room.offline = make(map[uuid.UUID]bool)
+	}
+	room.offline[id] = true
+}
+
+// takeSeat puts a reconnecting client back in the room if it was a member
+// when it disconnected, and reports whether it was.
+func (room *Room) takeSeat(client *Client) bool {
+	room.mu.Lock()
+	held := room.offline[client.ID]
+	delete(room.offline, client.ID)
+	room.mu.Unlock()
+
+	if !held {
+		return false
+	}
+
+	room.registerClientInRoom(client)
+	return true
+}
+
+// releaseSeat stops holding a seat for the user with the given ID, so they
+// are no longer a member when they reconnect.
+func (room *Room) releaseSeat(id uuid.UUID) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	delete(room.offline, id)
+}
+
+func (room *Room) memberCount() int {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	return len(room.clients)
+}
+
+// notifyMemberChange tells the other members of the room that client was
+// added or removed.
+func (room *Room) notifyMemberChange(action string, client *Client) {
+	changeMsg := &ClientEventMessage{
+		Action: action,
+		Client: client.summary(),
+		RoomID: &room.ID,
+	}
+	message := changeMsg.encode()
 
-	client.getRoomClients(room)
+	for _, member := range room.members() {
+		if member != client {
+			member.enqueue(message)
+		}
+	}
+}
 
+// sendMembers sends client the full member list of the room.
+func (room *Room) sendMembers(client *Client) {
+	roomListMsg := &RoomClientsListMessage{
+		Action:          RoomClientsListAction,
+		RoomClientsList: userSummaries(room.members()),
+	}
+	client.enqueue(roomListMsg.encode())
 }
 
 func (room *Room) broadcastToClientsInRoom(message []byte) {
-	for client := range room.clients {
-		client.send <- message
+	defer metrics.BroadcastFanout.ObserveSince(time.Now())
+
+	subject := broadcastSubject(message)
+	for _, client := range room.members() {
+		if !client.hasBlocked(subject) {
+			client.enqueue(message)
+		}
 	}
 }
 
@@ -84,10 +295,177 @@ func (room *Room) GetId() string {
 }
 
 func (room *Room) GetName() string {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
 	return room.Name
 }
 
+func (room *Room) setName(name string) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.Name = name
+}
+
+// summary describes the room for clients, read under its lock.
+func (room *Room) summary() RoomSummary {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	summary := RoomSummary{
+		ID:          room.ID,
+		Name:        room.Name,
+		DisplayName: room.DisplayName,
+		Topic:       room.Topic,
+		Description: room.Description,
+		AvatarColor: room.AvatarColor,
+		Private:     room.Private,
+		Ephemeral:   room.Ephemeral,
+		MemberCount: len(room.clients),
+		Retention:   room.Retention,
+	}
+	if room.Owner != nil {
+		summary.OwnerID = &room.Owner.ID
+	}
+
+	return summary
+}
+
+// MarshalJSON encodes the room's summary, so a room is never sent with its
+// members and history.
+func (room *Room) MarshalJSON() ([]byte, error) {
+	return json.Marshal(room.summary())
+}
+
+// history returns a copy of the room's messages.
+func (room *Room) history() []Message {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	messages := make([]Message, len(room.Messages))
+	copy(messages, room.Messages)
+	return messages
+}
+
+// members returns a copy of the room's member list.
+func (room *Room) members() []*Client {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	members := make([]*Client, len(room.Clients))
+	copy(members, room.Clients)
+	return members
+}
+
+// memberIDs returns the IDs of every member of the room, online or not.
+func (room *Room) memberIDs() []uuid.UUID {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	ids := make([]uuid.UUID, 0, len(room.Clients)+len(room.offline))
+	for _, client := range room.Clients {
+		ids = append(ids, client.ID)
+	}
+	for id := range room.offline {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// memberByID returns the online member with the given ID, or nil.
+func (room *Room) memberByID(id uuid.UUID) *Client {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for client := range room.clients {
+		if client.ID == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// hasClientID reports whether the user with the given ID is a member of the
+// room, whether they are online or not.
+func (room *Room) hasClientID(id uuid.UUID) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.offline[id] {
+		return true
+	}
+	for client := range room.clients {
+		if client.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (room *Room) hasClient(client *Client) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
 	_, ok := room.clients[client]
 	return ok
 }
+
+// takeMessages removes the room's whole history and returns it.
+func (room *Room) takeMessages() []Message {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	messages := room.Messages
+	room.Messages = make([]Message, 0)
+
+	return messages
+}
+
+func (room *Room) storeMessage(message Message) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.Messages = append(room.Messages, message)
+}
+
+// pruneMessages removes the messages that fall outside policy and returns
+// them.
+func (room *Room) pruneMessages(policy RetentionPolicy, now time.Time) []Message {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	cut := policy.expired(room.Messages, now)
+	if cut == 0 {
+		return nil
+	}
+
+	pruned := make([]Message, cut)
+	copy(pruned, room.Messages[:cut])
+	room.Messages = append(make([]Message, 0, len(room.Messages)-cut), room.Messages[cut:]...)
+
+	return pruned
+}
+
+func (room *Room) eachMessage(fn func(message *Message)) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for i := range room.Messages {
+		fn(&room.Messages[i])
+	}
+}
+
+func (room *Room) retentionPolicy() RetentionPolicy {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	return room.Retention
+}
+
+func (room *Room) setRetentionPolicy(policy RetentionPolicy) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.Retention = policy
+}
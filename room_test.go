@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewRoom(t *testing.T) {
@@ -35,7 +37,7 @@ func TestRoom_GetName(t *testing.T) {
 func TestRoomListMessage_encode(t *testing.T) {
 	msg := &RoomListMessage{
 		Action:   "testAction",
-		RoomList: []*Room{NewRoom("TestRoom", false, nil)},
+		RoomList: roomSummaries([]*Room{NewRoom("TestRoom", false, nil)}),
 	}
 
 	data := msg.encode()
@@ -66,3 +68,99 @@ func TestRoom_unregisterClientInRoom(t *testing.T) {
 
 	assert.NotContains(t, room.clients, client)
 }
+
+func TestRunRoom_MemberDeltas(t *testing.T) {
+	room := NewRoom("TestRoom", false, nil)
+	go room.RunRoom()
+	first := newClient(nil, nil, "first")
+	second := newClient(nil, nil, "second")
+
+	room.register <- first
+	room.register <- second
+	room.unregister <- second
+
+	var snapshot RoomClientsListMessage
+	assert.NoError(t, json.Unmarshal(<-first.send, &snapshot))
+	assert.Equal(t, RoomClientsListAction, snapshot.Action)
+	assert.Len(t, snapshot.RoomClientsList, 1)
+
+	var added ClientEventMessage
+	assert.NoError(t, json.Unmarshal(<-first.send, &added))
+	assert.Equal(t, RoomMemberAddedAction, added.Action)
+	assert.Equal(t, second.ID, added.Client.ID)
+	assert.Equal(t, room.ID, *added.RoomID)
+
+	var removed ClientEventMessage
+	assert.NoError(t, json.Unmarshal(<-first.send, &removed))
+	assert.Equal(t, RoomMemberRemovedAction, removed.Action)
+	assert.Equal(t, second.ID, removed.Client.ID)
+
+	assert.NoError(t, json.Unmarshal(<-second.send, &snapshot))
+	assert.Len(t, snapshot.RoomClientsList, 2)
+}
+
+func TestDeleteRoom_DetachesMembers(t *testing.T) {
+	server := NewWebsocketServer()
+	room := server.createRoom("general", false, nil)
+	client := newClient(nil, server, "test")
+	client.addRoom(room)
+	require.True(t, room.join(client))
+	assert.Equal(t, []uuid.UUID{room.ID}, client.RoomsIds)
+
+	var snapshot RoomClientsListMessage
+	require.NoError(t, json.Unmarshal(<-client.send, &snapshot))
+
+	server.deleteRoom(room)
+
+	var deleted RoomEventMessage
+	require.NoError(t, json.Unmarshal(<-client.send, &deleted))
+	assert.Equal(t, RoomDeletedAction, deleted.Action)
+	assert.Equal(t, room.ID, deleted.RoomID)
+	assert.Equal(t, "general", deleted.Name)
+
+	assert.False(t, client.isInRoom(room))
+	assert.Empty(t, client.RoomsIds)
+	assert.Zero(t, room.memberCount())
+
+	// The loop has stopped, so nothing sent to the room may block.
+	assert.False(t, room.join(client))
+	room.leave(client)
+	room.send(&Message{Action: SendMessageAction})
+}
+
+func TestDeleteRoom_OnlyPrivilegedClients(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "owner", "alice", "bob", "mallory")
+	owner, alice, bob, mallory := clients[0], clients[1], clients[2], clients[3]
+	public := server.createRoom("general", false, owner)
+	dm := server.openDM(alice, []*Client{bob})
+	requireMembers(t, dm, 2)
+
+	deleteRoom := func(client *Client, room *Room) {
+		client.handleNewMessage([]byte(`{"action":"delete-room","target":{"id":"` + room.GetId() + `"}}`))
+	}
+
+	deleteRoom(mallory, dm)
+	deleteRoom(mallory, public)
+	deleteRoom(alice, public)
+	assert.Len(t, server.roomsSnapshot(), 2, "Expected outsiders not to delete rooms")
+	assert.True(t, alice.isInRoom(dm))
+
+	deleteRoom(bob, dm)
+	assert.Nil(t, server.findRoomByID(dm.GetId()), "Expected members to delete their private room")
+
+	deleteRoom(owner, public)
+	assert.Empty(t, server.roomsSnapshot())
+}
+
+func TestRoom_idleFor(t *testing.T) {
+	now := time.Now()
+	room := NewRoom("TestRoom", false, nil)
+	client := newClient(nil, nil, "test")
+
+	room.registerClientInRoom(client)
+	assert.Zero(t, room.idleFor(now.Add(time.Hour)))
+
+	room.unregisterClientInRoom(client)
+	assert.InDelta(t, time.Hour, room.idleFor(time.Now().Add(time.Hour)), float64(time.Second))
+}
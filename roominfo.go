@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxRoomNameLength    = 100
+	maxDisplayNameLength = 100
+	maxTopicLength       = 250
+	maxDescriptionLength = 2000
+)
+
+var (
+	errRoomNameRequired   = errors.New("room name is required")
+	errRoomNameTooLong    = fmt.Errorf("room name is longer than %d characters", maxRoomNameLength)
+	errDisplayNameTooLong = fmt.Errorf("display name is longer than %d characters", maxDisplayNameLength)
+	errTopicTooLong       = fmt.Errorf("topic is longer than %d characters", maxTopicLength)
+	errDescriptionTooLong = fmt.Errorf("description is longer than %d characters", maxDescriptionLength)
+	errInvalidAvatarColor = errors.New("unknown avatar color")
+	errEmptyRoomUpdate    = errors.New("nothing to update")
+)
+
+// RoomUpdate is the payload of the update-room action. Fields that are left
+// out keep their value, an empty string clears them.
+type RoomUpdate struct {
+	DisplayName *string `json:"displayName,omitempty"`
+	Topic       *string `json:"topic,omitempty"`
+	Description *string `json:"description,omitempty"`
+	AvatarColor *string `json:"avatarColor,omitempty"`
+}
+
+func (update *RoomUpdate) isEmpty() bool {
+	return update.DisplayName == nil && update.Topic == nil && update.Description == nil && update.AvatarColor == nil
+}
+
+func (update *RoomUpdate) validate() error {
+	switch {
+	case update.isEmpty():
+		return errEmptyRoomUpdate
+	case update.DisplayName != nil && utf8.RuneCountInString(*update.DisplayName) > maxDisplayNameLength:
+		return errDisplayNameTooLong
+	case update.Topic != nil && utf8.RuneCountInString(*update.Topic) > maxTopicLength:
+		return errTopicTooLong
+	case update.Description != nil && utf8.RuneCountInString(*update.Description) > maxDescriptionLength:
+		return errDescriptionTooLong
+	case update.AvatarColor != nil && *update.AvatarColor != "" && !isAvatarColor(*update.AvatarColor):
+		return errInvalidAvatarColor
+	}
+
+	return nil
+}
+
+func (room *Room) applyUpdate(update *RoomUpdate) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if update.DisplayName != nil {
+		room.DisplayName = *update.DisplayName
+	}
+	if update.Topic != nil {
+		room.Topic = *update.Topic
+	}
+	if update.Description != nil {
+		room.Description = *update.Description
+	}
+	if update.AvatarColor != nil {
+		room.AvatarColor = *update.AvatarColor
+	}
+}
+
+// isPrivileged reports whether client may change the room. That is the
+// owner of a room, or any member of a private room.
+func (room *Room) isPrivileged(client *Client) bool {
+	if room.Owner != nil && room.Owner.ID == client.ID {
+		return true
+	}
+
+	return room.Private && room.hasClient(client)
+}
+
+// normalizeRoomName trims the whitespace around a new room name and checks
+// that something is left and that it is not too long.
+func normalizeRoomName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errRoomNameRequired
+	case utf8.RuneCountInString(name) > maxRoomNameLength:
+		return "", errRoomNameTooLong
+	}
+
+	return name, nil
+}
+
+// canRename reports whether room may be given name. Direct message rooms are
+// named after their participants, so neither they nor their names can be
+// chosen freely.
+func canRename(room *Room, name string) bool {
+	return !room.isDirectMessage() && !isDirectMessageName(name)
+}
+
+// notifyRoomUpdated sends the room's new details to everyone who can see it:
+// every client for a public room, only the members for a private one.
+func (server *WsServer) notifyRoomUpdated(room *Room, sender *Client) {
+	updatedMsg := &Message{
+		Action: RoomUpdatedAction,
+		Target: room,
+		Sender: sender,
+	}
+
+	if room.Private {
+		room.send(updatedMsg)
+		return
+	}
+	server.publishToClients(nil, updatedMsg.encode())
+}
+
+func (client *Client) handleUpdateRoomMessage(message Message) {
+	if message.RoomUpdate == nil || message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	if !room.isPrivileged(client) {
+		client.logger().Warn("Client is not allowed to update room", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	if err := message.RoomUpdate.validate(); err != nil {
+		client.logger().Warn("Rejected room update", roomAttr(room), "action", message.Action, "error", err)
+		return
+	}
+
+	room.applyUpdate(message.RoomUpdate)
+	client.wsServer.notifyRoomUpdated(room, client)
+}
+
+func (client *Client) handleRenameRoomMessage(message Message) {
+	if message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil {
+		return
+	}
+
+	name, err := normalizeRoomName(message.Message)
+	if err != nil {
+		client.logger().Warn("Rejected room name", roomAttr(room), "action", message.Action, "error", err)
+		return
+	}
+
+	if !room.isPrivileged(client) || !canRename(room, name) {
+		client.logger().Warn("Client is not allowed to rename room", roomAttr(room), "action", message.Action)
+		return
+	}
+
+	if !client.wsServer.renameRoom(room, name) {
+		client.logger().Warn("Room name is already taken", roomAttr(room), "action", message.Action, "name", name)
+		return
+	}
+
+	client.wsServer.notifyRoomUpdated(room, client)
+}
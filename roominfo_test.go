@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func TestRoomUpdate_validate(t *testing.T) {
+	assert.ErrorIs(t, (&RoomUpdate{}).validate(), errEmptyRoomUpdate)
+	assert.NoError(t, (&RoomUpdate{Topic: stringPtr("")}).validate())
+	assert.NoError(t, (&RoomUpdate{AvatarColor: stringPtr("teal-9")}).validate())
+	assert.ErrorIs(t, (&RoomUpdate{AvatarColor: stringPtr("plaid")}).validate(), errInvalidAvatarColor)
+	assert.ErrorIs(t, (&RoomUpdate{Topic: stringPtr(strings.Repeat("é", maxTopicLength+1))}).validate(), errTopicTooLong)
+	assert.NoError(t, (&RoomUpdate{Topic: stringPtr(strings.Repeat("é", maxTopicLength))}).validate())
+	assert.ErrorIs(t, (&RoomUpdate{DisplayName: stringPtr(strings.Repeat("a", maxDisplayNameLength+1))}).validate(), errDisplayNameTooLong)
+	assert.ErrorIs(t, (&RoomUpdate{Description: stringPtr(strings.Repeat("a", maxDescriptionLength+1))}).validate(), errDescriptionTooLong)
+}
+
+func TestUpdateRoom_PublicRoom(t *testing.T) {
+	server := NewWebsocketServer()
+	owner := newClient(nil, server, "owner")
+	other := newClient(nil, server, "other")
+	server.addClient(owner)
+	server.addClient(other)
+	room := server.createRoom("general", false, owner)
+
+	other.handleNewMessage([]byte(`{"action":"update-room","target":{"id":"` + room.GetId() + `"},"room":{"topic":"hijacked"}}`))
+	assert.Empty(t, room.summary().Topic, "Expected only the owner to update the room")
+	assert.Empty(t, other.send)
+
+	owner.handleNewMessage([]byte(`{"action":"update-room","target":{"id":"` + room.GetId() + `"},"room":{"topic":"Daily chat","displayName":"General"}}`))
+
+	summary := room.summary()
+	assert.Equal(t, "Daily chat", summary.Topic)
+	assert.Equal(t, "General", summary.DisplayName)
+	assert.Equal(t, "general", summary.Name)
+
+	// Everyone can see a public room, so everyone is told, members or not.
+	for _, client := range []*Client{owner, other} {
+		var updated MessageView
+		require.NoError(t, json.Unmarshal(<-client.send, &updated))
+		assert.Equal(t, RoomUpdatedAction, updated.Action)
+		assert.Equal(t, "Daily chat", updated.Target.Topic)
+		assert.Equal(t, owner.ID, updated.Sender.ID)
+	}
+
+	owner.handleNewMessage([]byte(`{"action":"update-room","target":{"id":"` + room.GetId() + `"},"room":{"avatarColor":"plaid"}}`))
+	assert.Empty(t, room.summary().AvatarColor)
+	assert.Empty(t, owner.send)
+}
+
+func TestUpdateRoom_PrivateRoom(t *testing.T) {
+	server := NewWebsocketServer()
+	owner := newClient(nil, server, "owner")
+	member := newClient(nil, server, "member")
+	outsider := newClient(nil, server, "outsider")
+	for _, client := range []*Client{owner, member, outsider} {
+		server.addClient(client)
+	}
+	room := server.createRoom("private", true, owner)
+	require.True(t, room.join(member))
+	<-member.send
+
+	member.handleNewMessage([]byte(`{"action":"update-room","target":{"id":"` + room.GetId() + `"},"room":{"description":"Just us"}}`))
+
+	var updated MessageView
+	require.NoError(t, json.Unmarshal(<-member.send, &updated))
+	assert.Equal(t, RoomUpdatedAction, updated.Action)
+	assert.Equal(t, "Just us", updated.Target.Description)
+	assert.Empty(t, outsider.send, "Expected only members to hear about a private room")
+}
+
+func TestRenameRoom(t *testing.T) {
+	server := NewWebsocketServer()
+	owner := newClient(nil, server, "owner")
+	server.addClient(owner)
+	room := server.createRoom("general", false, owner)
+	server.createRoom("taken", false, nil)
+
+	owner.handleNewMessage([]byte(`{"action":"rename-room","target":{"id":"` + room.GetId() + `"},"message":"taken"}`))
+	assert.Equal(t, "general", room.GetName())
+	assert.Empty(t, owner.send)
+
+	for _, name := range []string{"", "  \\t ", strings.Repeat("a", maxRoomNameLength+1)} {
+		owner.handleNewMessage([]byte(`{"action":"rename-room","target":{"id":"` + room.GetId() + `"},"message":"` + name + `"}`))
+		assert.Equal(t, "general", room.GetName(), "Expected %q to be rejected", name)
+	}
+	assert.Empty(t, owner.send)
+
+	owner.handleNewMessage([]byte(`{"action":"rename-room","target":{"id":"` + room.GetId() + `"},"message":"  lobby "}`))
+	assert.Equal(t, room, server.findRoomByName("lobby"))
+	assert.Nil(t, server.findRoomByName("general"))
+
+	var updated MessageView
+	require.NoError(t, json.Unmarshal(<-owner.send, &updated))
+	assert.Equal(t, RoomUpdatedAction, updated.Action)
+	assert.Equal(t, "lobby", updated.Target.Name)
+	assert.Equal(t, room.ID, updated.Target.ID)
+}
+
+func TestSendMessage_TargetFromServer(t *testing.T) {
+	server := NewWebsocketServer()
+	clients := connectedClients(server, "alice", "bob")
+	alice, bob := clients[0], clients[1]
+	room := server.createRoom("general", false, nil)
+	room.applyUpdate(&RoomUpdate{Topic: stringPtr("Daily chat")})
+	for _, client := range clients {
+		require.True(t, room.join(client))
+	}
+	requireMembers(t, room, 2)
+	for _, client := range clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+
+	alice.handleNewMessage([]byte(`{"action":"send-message","message":"hi","target":{"id":"` + room.GetId() + `","name":"Spoofed","topic":"Click here","private":true,"memberCount":999}}`))
+
+	var received MessageView
+	require.NoError(t, json.Unmarshal(<-bob.send, &received))
+	require.NotNil(t, received.Target)
+	assert.Equal(t, room.summary(), *received.Target)
+	assert.Equal(t, "general", room.history()[0].Target.GetName())
+}
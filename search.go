@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	snippetContext        = 60
+	snippetLength         = 200
+)
+
+// SearchQuery is the payload of the search-messages action. Query holds the
+// words to look for; text in double quotes must match as a phrase.
+type SearchQuery struct {
+	Query    string    `json:"query"`
+	RoomID   string    `json:"roomId,omitempty"`
+	SenderID string    `json:"senderId,omitempty"`
+	Sender   string    `json:"sender,omitempty"`
+	After    time.Time `json:"after"`
+	Before   time.Time `json:"before"`
+	Page     int       `json:"page,omitempty"`
+	PageSize int       `json:"pageSize,omitempty"`
+}
+
+// HighlightFragment is a piece of a search snippet. Fragments with Match set
+// are the parts of the message that matched the query.
+type HighlightFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+type SearchResult struct {
+	MessageID  uuid.UUID           `json:"messageId"`
+	RoomID     uuid.UUID           `json:"roomId"`
+	RoomName   string              `json:"roomName"`
+	SenderID   uuid.UUID           `json:"senderId"`
+	SenderName string              `json:"senderName"`
+	Message    string              `json:"message"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	Highlight  []HighlightFragment `json:"highlight"`
+}
+
+type SearchResults struct {
+	Query    string         `json:"query"`
+	Results  []SearchResult `json:"results"`
+	Total    int            `json:"total"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"pageSize"`
+}
+
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+type indexedMessage struct {
+	id         uuid.UUID
+	roomID     uuid.UUID
+	roomName   string
+	senderID   uuid.UUID
+	senderName string
+	text       string
+	createdAt  time.Time
+	tokens     []searchToken
+}
+
+// SearchIndex is an inverted index over the text of stored messages. Each
+// term maps to the messages containing it and the token positions it was
+// found at, which is what phrase queries are checked against.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[uuid.UUID][]int
+	messages map[uuid.UUID]*indexedMessage
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[uuid.UUID][]int),
+		messages: make(map[uuid.UUID]*indexedMessage),
+	}
+}
+
+func tokenize(text string) []searchToken {
+	tokens := make([]searchToken, 0)
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		}
+		if !isWord && start >= 0 {
+			tokens = append(tokens, searchToken{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+
+	return tokens
+}
+
+func (index *SearchIndex) Add(message *Message, room *Room) {
+	if message.Message == "" || message.Sender == nil {
+		return
+	}
+
+	indexed := &indexedMessage{
+		id:         message.ID,
+		roomID:     room.ID,
+		roomName:   room.GetName(),
+		senderID:   message.Sender.ID,
+		senderName: message.Sender.Name,
+		text:       message.Message,
+		createdAt:  message.CreatedAt,
+		tokens:     tokenize(message.Message),
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.removeLocked(message.ID)
+	index.messages[message.ID] = indexed
+	for position, token := range indexed.tokens {
+		postings, ok := index.postings[token.term]
+		if !ok {
+			postings = make(map[uuid.UUID][]int)
+			index.postings[token.term] = postings
+		}
+		postings[message.ID] = append(postings[message.ID], position)
+	}
+}
+
+func (index *SearchIndex) Remove(id uuid.UUID) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.removeLocked(id)
+}
+
+func (index *SearchIndex) RemoveRoom(roomID uuid.UUID) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	for id, message := range index.messages {
+		if message.roomID == roomID {
+			index.removeLocked(id)
+		}
+	}
+}
+
+func (index *SearchIndex) removeLocked(id uuid.UUID) {
+	message, ok := index.messages[id]
+	if !ok {
+		return
+	}
+
+	for _, token := range message.tokens {
+		if postings, ok := index.postings[token.term]; ok {
+			delete(postings, id)
+			if len(postings) == 0 {
+				delete(index.postings, token.term)
+			}
+		}
+	}
+	delete(index.messages, id)
+}
+
+// parseSearchQuery splits a query into the phrases it is made of. Every word
+// outside quotes is a phrase of its own.
+func parseSearchQuery(query string) [][]string {
+	phrases := make([][]string, 0)
+	for i, part := range strings.Split(query, `"`) {
+		tokens := tokenize(part)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if i%2 == 1 {
+			phrase := make([]string, 0, len(tokens))
+			for _, token := range tokens {
+				phrase = append(phrase, token.term)
+			}
+			phrases = append(phrases, phrase)
+			continue
+		}
+
+		for _, token := range tokens {
+			phrases = append(phrases, []string{token.term})
+		}
+	}
+
+	return phrases
+}
+
+// Search returns the messages matching query in the given rooms, newest
+// first.
+func (index *SearchIndex) Search(query SearchQuery, rooms map[uuid.UUID]bool) SearchResults {
+	page := max(query.Page, 1)
+	pageSize := query.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultSearchPageSize
+	}
+	pageSize = min(pageSize, maxSearchPageSize)
+
+	results := SearchResults{
+		Query:    query.Query,
+		Results:  make([]SearchResult, 0),
+		Page:     page,
+		PageSize: pageSize,
+	}
+
+	phrases := parseSearchQuery(query.Query)
+	if len(phrases) == 0 {
+		return results
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	matches := make([]*indexedMessage, 0)
+	matchedTokens := make(map[uuid.UUID]map[int]bool)
+	for id, positions := range index.postings[phrases[0][0]] {
+		message := index.messages[id]
+		if !index.matchesFilters(message, query, rooms) {
+			continue
+		}
+
+		highlighted := make(map[int]bool)
+		if !index.matchesPhrases(id, phrases, positions, highlighted) {
+			continue
+		}
+
+		matches = append(matches, message)
+		matchedTokens[id] = highlighted
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].createdAt.After(matches[j].createdAt)
+	})
+
+	results.Total = len(matches)
+	// Pages past the end are empty. They are checked before multiplying, as
+	// a huge page number would overflow.
+	from := len(matches)
+	if page-1 <= len(matches)/pageSize {
+		from = min((page-1)*pageSize, len(matches))
+	}
+	to := min(from+pageSize, len(matches))
+	for _, message := range matches[from:to] {
+		results.Results = append(results.Results, SearchResult{
+			MessageID:  message.id,
+			RoomID:     message.roomID,
+			RoomName:   message.roomName,
+			SenderID:   message.senderID,
+			SenderName: message.senderName,
+			Message:    message.text,
+			CreatedAt:  message.createdAt,
+			Highlight:  highlight(message, matchedTokens[message.id]),
+		})
+	}
+
+	return results
+}
+
+func (index *SearchIndex) matchesFilters(message *indexedMessage, query SearchQuery, rooms map[uuid.UUID]bool) bool {
+	if message == nil || !rooms[message.roomID] {
+		return false
+	}
+	if query.RoomID != "" && message.roomID.String() != query.RoomID {
+		return false
+	}
+	if query.SenderID != "" && message.senderID.String() != query.SenderID {
+		return false
+	}
+	if query.Sender != "" && !strings.EqualFold(message.senderName, query.Sender) {
+		return false
+	}
+	if !query.After.IsZero() && !message.createdAt.After(query.After) {
+		return false
+	}
+	if !query.Before.IsZero() && !message.createdAt.Before(query.Before) {
+		return false
+	}
+
+	return true
+}
+
+// matchesPhrases reports whether message id contains every phrase, and
+// records the positions of the matching tokens in highlighted.
+func (index *SearchIndex) matchesPhrases(id uuid.UUID, phrases [][]string, firstPositions []int, highlighted map[int]bool) bool {
+	for i, phrase := range phrases {
+		starts := firstPositions
+		if i > 0 {
+			starts = index.postings[phrase[0]][id]
+		}
+
+		found := false
+		for _, start := range starts {
+			if index.phraseAt(id, phrase, start) {
+				for offset := range phrase {
+					highlighted[start+offset] = true
+				}
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (index *SearchIndex) phraseAt(id uuid.UUID, phrase []string, start int) bool {
+	tokens := index.messages[id].tokens
+	if start+len(phrase) > len(tokens) {
+		return false
+	}
+
+	for offset, term := range phrase {
+		if tokens[start+offset].term != term {
+			return false
+		}
+	}
+
+	return true
+}
+
+// highlight cuts a snippet around the first match out of the message and
+// splits it into matching and non-matching fragments.
+func highlight(message *indexedMessage, matched map[int]bool) []HighlightFragment {
+	first := len(message.tokens)
+	for position := range matched {
+		first = min(first, position)
+	}
+
+	start := 0
+	if first < len(message.tokens) {
+		start = max(0, message.tokens[first].start-snippetContext)
+	}
+	for start > 0 && !utf8.RuneStart(message.text[start]) {
+		start--
+	}
+	end := min(len(message.text), start+snippetLength)
+	for end < len(message.text) && !utf8.RuneStart(message.text[end]) {
+		end++
+	}
+
+	fragments := make([]HighlightFragment, 0)
+	appendText := func(text string, match bool) {
+		if text == "" {
+			return
+		}
+		if last := len(fragments) - 1; last >= 0 && fragments[last].Match == match {
+			fragments[last].Text += text
+			return
+		}
+		fragments = append(fragments, HighlightFragment{Text: text, Match: match})
+	}
+
+	if start > 0 {
+		appendText("…", false)
+	}
+	pos := start
+	for position, token := range message.tokens {
+		if !matched[position] || token.start < start || token.end > end {
+			continue
+		}
+		// Keep the gap between two adjacent matched tokens inside the
+		// match, so a phrase comes out as one fragment.
+		appendText(message.text[pos:token.start], matched[position-1] && pos > start)
+		appendText(message.text[token.start:token.end], true)
+		pos = token.end
+	}
+	appendText(message.text[pos:end], false)
+	if end < len(message.text) {
+		appendText("…", false)
+	}
+
+	return fragments
+}
+
+func (client *Client) memberRoomIDs() map[uuid.UUID]bool {
+	rooms := make(map[uuid.UUID]bool)
+	for _, room := range client.roomsSnapshot() {
+		rooms[room.ID] = true
+	}
+
+	return rooms
+}
+
+func (client *Client) handleSearchMessage(message Message) {
+	if message.Search == nil {
+		return
+	}
+
+	resultsMsg := &SearchResultsMessage{
+		Action:        SearchResultsAction,
+		SearchResults: client.wsServer.search.Search(*message.Search, client.memberRoomIDs()),
+	}
+	client.enqueue(resultsMsg.encode())
+}
+
+// ServeSearch handles GET /search, the HTTP equivalent of the
+// search-messages action. The searching client is identified by the session
+// token it got on /ws and results are limited to the rooms it is in.
+func (server *WsServer) ServeSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client := server.authenticatedClient(r)
+	if client == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	query := SearchQuery{
+		Query:    params.Get("q"),
+		RoomID:   params.Get("roomId"),
+		SenderID: params.Get("senderId"),
+		Sender:   params.Get("sender"),
+	}
+
+	var err error
+	if query.After, err = parseSearchTime(params.Get("after")); err != nil {
+		http.Error(w, "invalid after: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Before, err = parseSearchTime(params.Get("before")); err != nil {
+		http.Error(w, "invalid before: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if value := params.Get("page"); value != "" {
+		if query.Page, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := params.Get("pageSize"); value != "" {
+		if query.PageSize, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid pageSize", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server.search.Search(query, client.memberRoomIDs()))
+}
+
+// parseSearchTime accepts RFC 3339 timestamps as well as plain dates.
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func indexTestMessage(index *SearchIndex, room *Room, sender *Client, text string, createdAt time.Time) *Message {
+	message := &Message{
+		ID:        uuid.New(),
+		Message:   text,
+		Sender:    sender,
+		CreatedAt: createdAt,
+	}
+	index.Add(message, room)
+	return message
+}
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Hello, wörld! 42")
+
+	require.Len(t, tokens, 3)
+	assert.Equal(t, "hello", tokens[0].term)
+	assert.Equal(t, "wörld", tokens[1].term)
+	assert.Equal(t, "Hello, wörld! 42"[tokens[1].start:tokens[1].end], "wörld")
+	assert.Equal(t, "42", tokens[2].term)
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	phrases := parseSearchQuery(`lunch "next friday" pizza`)
+
+	assert.Equal(t, [][]string{{"lunch"}, {"next", "friday"}, {"pizza"}}, phrases)
+}
+
+func TestSearchIndex_Search(t *testing.T) {
+	index := NewSearchIndex()
+	room := NewRoom("general", false, nil)
+	alice := &Client{ID: uuid.New(), Name: "Alice"}
+	bob := &Client{ID: uuid.New(), Name: "Bob"}
+	now := time.Now()
+
+	older := indexTestMessage(index, room, alice, "Lunch next Friday?", now.Add(-time.Hour))
+	newer := indexTestMessage(index, room, bob, "Friday next week works for lunch", now)
+	rooms := map[uuid.UUID]bool{room.ID: true}
+
+	results := index.Search(SearchQuery{Query: "lunch friday"}, rooms)
+	require.Equal(t, 2, results.Total)
+	assert.Equal(t, newer.ID, results.Results[0].MessageID)
+	assert.Equal(t, older.ID, results.Results[1].MessageID)
+
+	results = index.Search(SearchQuery{Query: `"next friday"`}, rooms)
+	require.Equal(t, 1, results.Total)
+	assert.Equal(t, older.ID, results.Results[0].MessageID)
+	assert.Equal(t, []HighlightFragment{
+		{Text: "Lunch "},
+		{Text: "next Friday", Match: true},
+		{Text: "?"},
+	}, results.Results[0].Highlight)
+
+	results = index.Search(SearchQuery{Query: "lunch", Sender: "alice"}, rooms)
+	require.Equal(t, 1, results.Total)
+	assert.Equal(t, older.ID, results.Results[0].MessageID)
+
+	results = index.Search(SearchQuery{Query: "lunch", After: now.Add(-time.Minute)}, rooms)
+	require.Equal(t, 1, results.Total)
+	assert.Equal(t, newer.ID, results.Results[0].MessageID)
+
+	results = index.Search(SearchQuery{Query: "lunch", Page: 2, PageSize: 1}, rooms)
+	assert.Equal(t, 2, results.Total)
+	require.Len(t, results.Results, 1)
+	assert.Equal(t, older.ID, results.Results[0].MessageID)
+
+	for _, page := range []int{3, math.MaxInt64 / 10, math.MaxInt} {
+		results = index.Search(SearchQuery{Query: "lunch", Page: page, PageSize: 1}, rooms)
+		assert.Equal(t, 2, results.Total)
+		assert.Empty(t, results.Results, "Expected page %d to be empty", page)
+	}
+}
+
+func TestSearchIndex_ScopedToRooms(t *testing.T) {
+	index := NewSearchIndex()
+	room := NewRoom("general", false, nil)
+	secret := NewRoom("secret", true, nil)
+	alice := &Client{ID: uuid.New(), Name: "Alice"}
+
+	indexTestMessage(index, room, alice, "public plans", time.Now())
+	indexTestMessage(index, secret, alice, "secret plans", time.Now())
+
+	results := index.Search(SearchQuery{Query: "plans"}, map[uuid.UUID]bool{room.ID: true})
+
+	require.Equal(t, 1, results.Total)
+	assert.Equal(t, room.ID, results.Results[0].RoomID)
+}
+
+func TestSearchIndex_Remove(t *testing.T) {
+	index := NewSearchIndex()
+	room := NewRoom("general", false, nil)
+	alice := &Client{ID: uuid.New(), Name: "Alice"}
+	rooms := map[uuid.UUID]bool{room.ID: true}
+
+	message := indexTestMessage(index, room, alice, "forget me", time.Now())
+	index.Remove(message.ID)
+	assert.Equal(t, 0, index.Search(SearchQuery{Query: "forget"}, rooms).Total)
+	assert.Empty(t, index.postings)
+
+	indexTestMessage(index, room, alice, "forget me too", time.Now())
+	index.RemoveRoom(room.ID)
+	assert.Equal(t, 0, index.Search(SearchQuery{Query: "forget"}, rooms).Total)
+}
+
+func TestServeSearch(t *testing.T) {
+	server := NewWebsocketServer()
+	room := NewRoom("general", false, nil)
+	client := newClient(nil, server, "Alice")
+	client.rooms[room] = true
+	server.addClient(client)
+	indexTestMessage(server.search, room, client, "hello there", time.Now())
+
+	outsider := newClient(nil, server, "Mallory")
+	server.addClient(outsider)
+
+	search := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeSearch(rec, req)
+		return rec
+	}
+
+	rec := search("q=hello", client.token)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var results SearchResults
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Equal(t, 1, results.Total)
+
+	// Knowing a client's ID is not enough to search its rooms.
+	assert.Equal(t, http.StatusUnauthorized, search("q=hello&clientId="+client.ID.String(), "").Code)
+	assert.Equal(t, http.StatusUnauthorized, search("q=hello", client.ID.String()).Code)
+	assert.Equal(t, http.StatusUnauthorized, search("q=hello", uuid.NewString()).Code)
+
+	rec = search("q=hello&page="+strconv.Itoa(math.MaxInt), client.token)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Equal(t, 1, results.Total)
+	assert.Empty(t, results.Results)
+
+	rec = search("q=hello", outsider.token)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Equal(t, 0, results.Total, "Expected a third party to find nothing")
+}
+
+func TestHandleSearchMessage_HugePage(t *testing.T) {
+	server := NewWebsocketServer()
+	room := NewRoom("general", false, nil)
+	client := newClient(nil, server, "Alice")
+	client.rooms[room] = true
+	indexTestMessage(server.search, room, client, "hello there", time.Now())
+
+	client.handleNewMessage([]byte(`{"action":"search-messages","search":{"query":"hello","page":` + strconv.Itoa(math.MaxInt) + `}}`))
+
+	var results SearchResultsMessage
+	require.NoError(t, json.Unmarshal(<-client.send, &results))
+	assert.Equal(t, SearchResultsAction, results.Action)
+	assert.Equal(t, 1, results.Total)
+	assert.Empty(t, results.Results)
+}
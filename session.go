@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// newSessionToken returns a random token that only the connection it is
+// issued to learns, unlike client IDs which every other client sees.
+func newSessionToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+
+	return hex.EncodeToString(token)
+}
+
+// clientByToken returns the connected client the session token was issued
+// to, or nil.
+func (server *WsServer) clientByToken(token string) *Client {
+	if token == "" {
+		return nil
+	}
+
+	for _, client := range server.clientsSnapshot() {
+		if subtle.ConstantTimeCompare([]byte(client.token), []byte(token)) == 1 {
+			return client
+		}
+	}
+
+	return nil
+}
+
+// authenticatedClient returns the client whose session token the request
+// carries as "Authorization: Bearer <token>", or nil.
+func (server *WsServer) authenticatedClient(r *http.Request) *Client {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+
+	return server.clientByToken(token)
+}
+
+// resumeSession returns the ID of the client a reconnecting connection asks
+// to continue as, if it presents the session token that client was issued.
+// The token outlives the connection, so mentions and blocks are kept across
+// reconnects without letting anyone who knows the ID take them over.
+func (server *WsServer) resumeSession(id, token string) (uuid.UUID, bool) {
+	clientID, err := uuid.Parse(id)
+	if err != nil || token == "" {
+		return uuid.Nil, false
+	}
+
+	server.mutex.Lock()
+	issued, ok := server.sessions[clientID]
+	server.mutex.Unlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(issued), []byte(token)) != 1 {
+		return uuid.Nil, false
+	}
+
+	return clientID, true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// typingTimeout is how long a client is shown as typing without
+	// hearing from it again.
+	typingTimeout = 6 * time.Second
+	// typingDebounce is the shortest interval between two "typing" events
+	// the server forwards for the same client and room.
+	typingDebounce = 2 * time.Second
+)
+
+type typingState struct {
+	room     *Room
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+// SetTyping handles a typing-action for the room in message.Target. Only
+// members of that room are told, repeated "true" events are debounced and a
+// "false" is sent on the client's behalf if it goes quiet.
+func (client *Client) SetTyping(message Message) {
+	if message.Target == nil {
+		return
+	}
+
+	room := client.wsServer.findRoomByID(message.Target.GetId())
+	if room == nil || !client.isInRoom(room) {
+		return
+	}
+
+	if message.Message == "true" {
+		client.startTyping(room)
+	} else {
+		client.stopTyping(room.ID)
+	}
+}
+
+func (client *Client) startTyping(room *Room) {
+	client.typingMu.Lock()
+	defer client.typingMu.Unlock()
+
+	now := time.Now()
+	state, ok := client.typing[room.ID]
+	if ok {
+		state.timer.Reset(typingTimeout)
+		if now.Sub(state.lastSent) < typingDebounce {
+			return
+		}
+		state.lastSent = now
+	} else {
+		state = &typingState{
+			room:     room,
+			lastSent: now,
+			timer: time.AfterFunc(typingTimeout, func() {
+				client.stopTyping(room.ID)
+			}),
+		}
+		client.typing[room.ID] = state
+	}
+
+	room.send(client.typingMessage(room, true))
+}
+
+func (client *Client) stopTyping(roomID uuid.UUID) {
+	client.typingMu.Lock()
+	defer client.typingMu.Unlock()
+
+	state, ok := client.typing[roomID]
+	if !ok {
+		return
+	}
+
+	state.timer.Stop()
+	delete(client.typing, roomID)
+
+	state.room.send(client.typingMessage(state.room, false))
+}
+
+// stopAllTyping ends every typing indicator of the client, used when it
+// disconnects.
+func (client *Client) stopAllTyping() {
+	client.typingMu.Lock()
+	roomIDs := make([]uuid.UUID, 0, len(client.typing))
+	for roomID := range client.typing {
+		roomIDs = append(roomIDs, roomID)
+	}
+	client.typingMu.Unlock()
+
+	for _, roomID := range roomIDs {
+		client.stopTyping(roomID)
+	}
+}
+
+func (client *Client) typingMessage(room *Room, typing bool) *Message {
+	message := &Message{
+		Action:  TypingAction,
+		Message: "false",
+		Target:  &Room{ID: room.ID, Name: room.GetName(), Private: room.Private},
+		Sender:  client,
+	}
+	if typing {
+		message.Message = "true"
+	}
+
+	return message
+}
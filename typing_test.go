@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTypingTestRoom(server *WsServer, client *Client) *Room {
+	room := NewRoom("TestRoom", false, nil)
+	server.addRoom(room)
+	client.rooms[room] = true
+	return room
+}
+
+func expectTyping(t *testing.T, room *Room, client *Client, typing string) {
+	select {
+	case message := <-room.broadcast:
+		assert.Equal(t, TypingAction, message.Action)
+		assert.Equal(t, typing, message.Message)
+		assert.Equal(t, client, message.Sender)
+		assert.Equal(t, room.ID, message.Target.ID)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected typing %s to be broadcast", typing)
+	}
+}
+
+func expectNoTyping(t *testing.T, room *Room) {
+	select {
+	case message := <-room.broadcast:
+		t.Fatalf("Expected no broadcast, got typing %s", message.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func typingAction(room *Room, typing string) Message {
+	return Message{Action: TypingAction, Message: typing, Target: &Room{ID: room.ID}}
+}
+
+func TestSetTyping_DebouncesAndStops(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	room := newTypingTestRoom(server, client)
+
+	go client.SetTyping(typingAction(room, "true"))
+	expectTyping(t, room, client, "true")
+
+	go client.SetTyping(typingAction(room, "true"))
+	expectNoTyping(t, room)
+
+	go client.SetTyping(typingAction(room, "false"))
+	expectTyping(t, room, client, "false")
+
+	go client.SetTyping(typingAction(room, "false"))
+	expectNoTyping(t, room)
+}
+
+func TestSetTyping_OnlyTargetRoom(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	target := newTypingTestRoom(server, client)
+	other := newTypingTestRoom(server, client)
+
+	go client.SetTyping(typingAction(target, "true"))
+	expectTyping(t, target, client, "true")
+	expectNoTyping(t, other)
+}
+
+func TestSetTyping_IgnoresRoomsClientIsNotIn(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	room := newTypingTestRoom(server, client)
+	delete(client.rooms, room)
+
+	go client.SetTyping(typingAction(room, "true"))
+	expectNoTyping(t, room)
+}
+
+func TestSetTyping_Expires(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	room := newTypingTestRoom(server, client)
+
+	go client.SetTyping(typingAction(room, "true"))
+	expectTyping(t, room, client, "true")
+
+	client.typingMu.Lock()
+	state := client.typing[room.ID]
+	require.NotNil(t, state)
+	state.timer.Reset(10 * time.Millisecond)
+	client.typingMu.Unlock()
+
+	expectTyping(t, room, client, "false")
+}
+
+func TestStopAllTyping(t *testing.T) {
+	server := NewWebsocketServer()
+	client := newClient(nil, server, "test")
+	room := newTypingTestRoom(server, client)
+
+	go client.SetTyping(typingAction(room, "true"))
+	expectTyping(t, room, client, "true")
+
+	go client.stopAllTyping()
+	expectTyping(t, room, client, "false")
+}